@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// AdminAPI is a small HTTP/JSON API for managing a running Kurafuto. Every
+// request must carry the configured token, as "Authorization: Bearer <token>".
+//
+//	GET  /players                             list connected players
+//	POST /kick      {"player", "reason"}      kick a player (by id or name)
+//	POST /move      {"player", "server"}      move a player to another server
+//	POST /broadcast {"message"}               send a chat message to everyone
+//	GET  /servers                             list servers and their health
+//	POST /reload                              reload the config file
+//	POST /drain     {"server", "draining", "duration"}  mark a server as draining (or not),
+//	                                          and move everyone off it after duration
+//	POST /shutdown  {"duration"}              drain and shut down Kurafuto (now, with "0s")
+//	POST /capture   {"player", "capture"}     start (or stop) capturing a player's packets
+//	GET  /bans                                list bans
+//	POST /ban       {"target", "duration", "reason"}  ban a name, IP or CIDR range
+//	POST /unban     {"target"}                lift a ban
+//	GET  /whitelist                           show the whitelist
+//	POST /whitelist {"action", "server", "names"}  "on"/"off" (for the proxy, or one
+//	                                          server), or "add"/"remove" names
+//	GET  /mesh                                show this node's mesh peers
+type AdminAPI struct {
+	ku    *Kurafuto
+	token string
+	mux   *http.ServeMux
+}
+
+type playerInfo struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Remote    string    `json:"remote"`
+	Backend   string    `json:"backend"`
+	CPE       bool      `json:"cpe"`
+	State     string    `json:"state"`
+	Connected time.Time `json:"connected"`
+}
+
+type serverInfo struct {
+	Name     string    `json:"name"`
+	Address  string    `json:"address"`
+	Healthy  bool      `json:"healthy"`
+	Draining bool      `json:"draining"`
+	Players  int       `json:"players"`
+	Max      int       `json:"max-players"`
+	Checked  time.Time `json:"checked"`
+}
+
+// adminRequest holds the fields any of the POST endpoints might take.
+type adminRequest struct {
+	Player   string   `json:"player"`
+	Reason   string   `json:"reason"`
+	Server   string   `json:"server"`
+	Message  string   `json:"message"`
+	Draining *bool    `json:"draining"`
+	Capture  *bool    `json:"capture"`
+	Target   string   `json:"target"`
+	Duration string   `json:"duration"`
+	Action   string   `json:"action"`
+	Names    []string `json:"names"`
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+a.token)) != 1 {
+		a.error(w, http.StatusUnauthorized, errors.New("bad token"))
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *AdminAPI) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *AdminAPI) error(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// post wraps a handler which only accepts POSTs with a JSON body.
+func (a *AdminAPI) post(f func(http.ResponseWriter, *adminRequest)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			a.error(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+			return
+		}
+		var req adminRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				a.error(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		f(w, &req)
+	}
+}
+
+// player looks up the player named in a request, replying with an error if
+// they can't be found.
+func (a *AdminAPI) player(w http.ResponseWriter, req *adminRequest) *Player {
+	p := a.ku.Players.Find(req.Player)
+	if p == nil {
+		a.error(w, http.StatusNotFound, fmt.Errorf("no player %q", req.Player))
+	}
+	return p
+}
+
+// server looks up the server named in a request, replying with an error if it
+// doesn't exist.
+func (a *AdminAPI) server(w http.ResponseWriter, req *adminRequest) *Backend {
+	b := a.ku.Backend(req.Server)
+	if b == nil {
+		a.error(w, http.StatusNotFound, fmt.Errorf("no server %q", req.Server))
+	}
+	return b
+}
+
+func (a *AdminAPI) players(w http.ResponseWriter, r *http.Request) {
+	list := []playerInfo{}
+	for _, p := range a.ku.Players.Snapshot() {
+		info := playerInfo{
+			Id:        p.Id,
+			Name:      p.Name(),
+			Remote:    p.Remote(),
+			CPE:       p.CPE(),
+			State:     p.State().String(),
+			Connected: p.Connected,
+		}
+		if b := p.Backend(); b != nil {
+			info.Backend = string(b.Name)
+		}
+		list = append(list, info)
+	}
+	a.reply(w, list)
+}
+
+func (a *AdminAPI) kick(w http.ResponseWriter, req *adminRequest) {
+	p := a.player(w, req)
+	if p == nil {
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "Kicked by an admin."
+	}
+	p.Log().Event("kick").Infof("Admin API kicked %s (%s): %s", p.Name(), p.Remote(), req.Reason)
+	if err := p.Kick(req.Reason); err != nil {
+		a.error(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.reply(w, map[string]bool{"ok": true})
+}
+
+func (a *AdminAPI) move(w http.ResponseWriter, req *adminRequest) {
+	p := a.player(w, req)
+	if p == nil {
+		return
+	}
+	b := a.server(w, req)
+	if b == nil {
+		return
+	}
+	if err := p.Move(b); err != nil {
+		a.error(w, http.StatusConflict, err)
+		return
+	}
+	a.reply(w, map[string]bool{"ok": true})
+}
+
+func (a *AdminAPI) broadcast(w http.ResponseWriter, req *adminRequest) {
+	if req.Message == "" {
+		a.error(w, http.StatusBadRequest, errors.New("no message"))
+		return
+	}
+	a.ku.Broadcast(req.Message)
+	a.reply(w, map[string]bool{"ok": true})
+}
+
+func (a *AdminAPI) servers(w http.ResponseWriter, r *http.Request) {
+	list := []serverInfo{}
+	for _, b := range a.ku.Backends() {
+		list = append(list, serverInfo{
+			Name:     string(b.Name),
+			Address:  b.Addr(),
+			Healthy:  b.Healthy(),
+			Draining: b.Draining(),
+			Players:  a.ku.Players.Count(b),
+			Max:      b.MaxPlayers,
+			Checked:  b.Checked(),
+		})
+	}
+	a.reply(w, list)
+}
+
+func (a *AdminAPI) reload(w http.ResponseWriter, req *adminRequest) {
+	if err := a.ku.Reload(); err != nil {
+		a.error(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.reply(w, map[string]bool{"ok": true})
+}
+
+func (a *AdminAPI) drain(w http.ResponseWriter, req *adminRequest) {
+	b := a.server(w, req)
+	if b == nil {
+		return
+	}
+	draining := true
+	if req.Draining != nil {
+		draining = *req.Draining
+	}
+	if draining && req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			a.error(w, http.StatusBadRequest, err)
+			return
+		}
+		Infof("Admin API draining %s in %s", b.Name, d)
+		go a.ku.DrainBackend(b, d)
+		a.reply(w, map[string]bool{"ok": true})
+		return
+	}
+	b.SetDraining(draining)
+	Infof("Admin API set %s draining: %v", b.Name, draining)
+	a.reply(w, map[string]bool{"ok": true})
+}
+
+func (a *AdminAPI) shutdown(w http.ResponseWriter, req *adminRequest) {
+	d := time.Duration(a.ku.Config().Drain.Deadline)
+	if req.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(req.Duration); err != nil {
+			a.error(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	Infof("Admin API shutting down in %s", d)
+	go a.ku.Drain(d)
+	a.reply(w, map[string]bool{"ok": true})
+}
+
+func (a *AdminAPI) capture(w http.ResponseWriter, req *adminRequest) {
+	p := a.player(w, req)
+	if p == nil {
+		return
+	}
+	var err error
+	if req.Capture == nil || *req.Capture {
+		err = p.StartCapture(a.ku.Config().Capture.Dir)
+	} else {
+		err = p.StopCapture()
+	}
+	if err != nil {
+		a.error(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.reply(w, map[string]bool{"ok": true})
+}
+
+func (a *AdminAPI) bans(w http.ResponseWriter, r *http.Request) {
+	a.reply(w, a.ku.Bans.List())
+}
+
+func (a *AdminAPI) mesh(w http.ResponseWriter, r *http.Request) {
+	if a.ku.Mesh == nil {
+		a.error(w, http.StatusNotFound, errors.New("the mesh isn't enabled"))
+		return
+	}
+	a.reply(w, map[string]interface{}{
+		"node":  a.ku.Mesh.Node(),
+		"peers": a.ku.Mesh.States(),
+	})
+}
+
+func (a *AdminAPI) ban(w http.ResponseWriter, req *adminRequest) {
+	var d time.Duration
+	if req.Duration != "" {
+		var err error
+		if d, err = ParseBanDuration(req.Duration); err != nil {
+			a.error(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	ban, err := a.ku.Ban(req.Target, d, req.Reason, "ADMIN")
+	if err != nil {
+		a.error(w, http.StatusBadRequest, err)
+		return
+	}
+	a.reply(w, ban)
+}
+
+func (a *AdminAPI) unban(w http.ResponseWriter, req *adminRequest) {
+	if err := a.ku.Unban(req.Target, "ADMIN"); err != nil {
+		a.error(w, http.StatusNotFound, err)
+		return
+	}
+	a.reply(w, map[string]bool{"ok": true})
+}
+
+func (a *AdminAPI) whitelist(w http.ResponseWriter, r *http.Request) {
+	wl := a.ku.Whitelist
+	if r.Method != "POST" {
+		servers := []string{}
+		for _, b := range a.ku.Backends() {
+			if b.Whitelist || wl.Server(string(b.Name)) {
+				servers = append(servers, string(b.Name))
+			}
+		}
+		a.reply(w, whitelistFile{Enabled: wl.Enabled(), Servers: servers, Names: wl.Names()})
+		return
+	}
+
+	a.post(func(w http.ResponseWriter, req *adminRequest) {
+		var err error
+		switch req.Action {
+		case "on", "off":
+			if req.Server == "" {
+				err = wl.SetEnabled(req.Action == "on")
+			} else if a.server(w, req) == nil {
+				return
+			} else {
+				err = wl.SetServer(req.Server, req.Action == "on")
+			}
+		case "add":
+			err = wl.Add(req.Names...)
+		case "remove":
+			err = wl.Remove(req.Names...)
+		default:
+			a.error(w, http.StatusBadRequest, fmt.Errorf("unknown action %q", req.Action))
+			return
+		}
+		if err != nil {
+			a.error(w, http.StatusInternalServerError, err)
+			return
+		}
+		a.reply(w, map[string]bool{"ok": true})
+	})(w, r)
+}
+
+func NewAdminAPI(ku *Kurafuto, token string) *AdminAPI {
+	a := &AdminAPI{ku: ku, token: token, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/players", a.players)
+	a.mux.HandleFunc("/kick", a.post(a.kick))
+	a.mux.HandleFunc("/move", a.post(a.move))
+	a.mux.HandleFunc("/broadcast", a.post(a.broadcast))
+	a.mux.HandleFunc("/servers", a.servers)
+	a.mux.HandleFunc("/reload", a.post(a.reload))
+	a.mux.HandleFunc("/drain", a.post(a.drain))
+	a.mux.HandleFunc("/shutdown", a.post(a.shutdown))
+	a.mux.HandleFunc("/capture", a.post(a.capture))
+	a.mux.HandleFunc("/bans", a.bans)
+	a.mux.HandleFunc("/ban", a.post(a.ban))
+	a.mux.HandleFunc("/unban", a.post(a.unban))
+	a.mux.HandleFunc("/whitelist", a.whitelist)
+	a.mux.HandleFunc("/mesh", a.mesh)
+	return a
+}
+
+// ServeAdmin serves the admin API on addr. It blocks, like http.ListenAndServe,
+// so it should be run in its own goroutine.
+func ServeAdmin(ku *Kurafuto, addr, token string) error {
+	l, err := listen("admin", addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, NewAdminAPI(ku, token))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	admin := NewAdminAPI(testKurafuto(t), "token")
+
+	tests := []struct {
+		name     string
+		auth     string
+		expected int
+	}{
+		{"bearer", "Bearer token", http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"no scheme", "token", http.StatusUnauthorized},
+		{"wrong scheme", "Basic token", http.StatusUnauthorized},
+		{"lowercase scheme", "bearer token", http.StatusUnauthorized},
+		{"no space", "Bearertoken", http.StatusUnauthorized},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"empty token", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/players", nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if rec.Code != test.expected {
+			t.Errorf("%s: Authorization %q gave %d, want %d", test.name, test.auth, rec.Code, test.expected)
+		}
+	}
+}
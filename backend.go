@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errBackendFull is returned when moving a player to a backend with no room.
+var errBackendFull = errors.New("kurafuto: Server is full")
+
+// A Backend is a configured Server, along with the runtime state Kurafuto keeps
+// about it: whether it's reachable, and whether it's draining (not taking on any
+// new players).
+type Backend struct {
+	Server
+
+	healthy  bool
+	draining bool
+	checked  time.Time
+	mutex    sync.Mutex
+}
+
+// Healthy returns whether the last health check (or dial) to this backend was
+// successful.
+func (b *Backend) Healthy() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.healthy
+}
+
+// Draining returns whether this backend is draining.
+func (b *Backend) Draining() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.draining
+}
+
+// SetDraining marks this backend as draining (or not). A draining backend won't
+// be picked for new players, but existing players are left alone.
+func (b *Backend) SetDraining(d bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.draining = d
+}
+
+// Checked returns when this backend's health was last updated.
+func (b *Backend) Checked() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.checked
+}
+
+func (b *Backend) setHealthy(h bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.healthy != h {
+		if h {
+			Infof("Server %s (%s) is back up", b.Name, b.Addr())
+		} else {
+			Warnf("Server %s (%s) is down", b.Name, b.Addr())
+		}
+	}
+	b.healthy = h
+	b.checked = time.Now()
+}
+
+// hearHealth updates this backend's health from a check made by a mesh peer,
+// if it's more recent than our own.
+func (b *Backend) hearHealth(h bool, checked time.Time, node string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !checked.After(b.checked) {
+		return
+	}
+	if b.healthy != h {
+		if h {
+			Infof("Server %s (%s) is back up, according to %s", b.Name, b.Addr(), node)
+		} else {
+			Warnf("Server %s (%s) is down, according to %s", b.Name, b.Addr(), node)
+		}
+	}
+	b.healthy = h
+	b.checked = checked
+}
+
+// Available returns whether new players can be sent to this backend.
+func (b *Backend) Available() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.healthy && !b.draining
+}
+
+// Check dials the backend to see whether it's accepting connections, and updates
+// its health to match.
+func (b *Backend) Check(timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", b.Addr(), timeout)
+	if err != nil {
+		Debugf("Health check for %s failed: %s", b.Name, err)
+		b.setHealthy(false)
+		return false
+	}
+	conn.Close()
+	b.setHealthy(true)
+	return true
+}
+
+func NewBackend(s Server) *Backend {
+	// Assume everything is fine until we hear otherwise.
+	return &Backend{Server: s, healthy: true}
+}
+
+////
+
+// Backends returns a copy of the backend list, in config order.
+func (ku *Kurafuto) Backends() []*Backend {
+	ku.bMut.Lock()
+	defer ku.bMut.Unlock()
+	b := make([]*Backend, len(ku.backends))
+	copy(b, ku.backends)
+	return b
+}
+
+// Backend returns the backend with the given name (case insensitive), or nil.
+func (ku *Kurafuto) Backend(name string) *Backend {
+	for _, b := range ku.Backends() {
+		if strings.EqualFold(string(b.Name), name) {
+			return b
+		}
+	}
+	return nil
+}
+
+// Pick chooses a backend for a player: the first available backend they're
+// allowed on with room for them, in config order (so the hub is preferred),
+// unless they have a sticky session on another one which can take them. The
+// player's place there is reserved in the registry. It returns nil if none are
+// available.
+func (ku *Kurafuto) Pick(p *Player) *Backend {
+	if b := ku.lastServer(p); b != nil && b.Available() && ku.AllowedOn(p.Name(), b) && ku.Players.Reserve(p, b) {
+		return b
+	}
+	for _, b := range ku.Backends() {
+		if b.Available() && ku.AllowedOn(p.Name(), b) && ku.Players.Reserve(p, b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// anyHealthy returns whether any backend is up.
+func (ku *Kurafuto) anyHealthy() bool {
+	for _, b := range ku.Backends() {
+		if b.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// setBackends (re)builds the backend list from the configured servers. State
+// is carried over for any server that keeps the same name, along with its
+// players.
+func (ku *Kurafuto) setBackends(servers []Server) {
+	ku.bMut.Lock()
+	old := map[ident]*Backend{}
+	for _, b := range ku.backends {
+		old[b.Name] = b
+	}
+
+	backends := []*Backend{}
+	replaced := map[*Backend]*Backend{}
+	for _, s := range servers {
+		if b, ok := old[s.Name]; ok && b.Server == s {
+			backends = append(backends, b)
+			continue
+		}
+		b := NewBackend(s)
+		if o, ok := old[s.Name]; ok {
+			b.draining = o.Draining()
+			replaced[o] = b
+		}
+		backends = append(backends, b)
+	}
+	ku.backends = backends
+	ku.lobby = NewLobby(backends)
+	ku.bMut.Unlock()
+
+	for from, to := range replaced {
+		for _, p := range ku.Players.Rebind(from, to) {
+			p.sMutex.Lock()
+			if p.backend == from {
+				p.backend = to
+			}
+			p.sMutex.Unlock()
+		}
+	}
+}
+
+// checkBackends health checks every backend every interval, until Kurafuto
+// stops running.
+func (ku *Kurafuto) checkBackends(interval time.Duration) {
+	for {
+		ku.rMut.Lock()
+		running := ku.Running
+		ku.rMut.Unlock()
+		if !running {
+			return
+		}
+
+		for _, b := range ku.Backends() {
+			b.Check(5 * time.Second)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Ban keeps a player (by name) or an address (a single IP, or a CIDR range)
+// out of Kurafuto, until it expires (if it ever does).
+type Ban struct {
+	Name    string     `json:"name,omitempty"`
+	IP      string     `json:"ip,omitempty"` // Either an IP, or a CIDR range.
+	Reason  string     `json:"reason"`
+	By      string     `json:"by"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Target returns what the ban is against, a name or an address.
+func (b *Ban) Target() string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return b.IP
+}
+
+// Expired returns whether the ban has expired.
+func (b *Ban) Expired() bool {
+	return b.Expires != nil && time.Now().After(*b.Expires)
+}
+
+// Matches returns whether the ban applies to a player with the given name,
+// connecting from the given IP.
+func (b *Ban) Matches(name string, ip net.IP) bool {
+	if b.Name != "" {
+		return strings.EqualFold(b.Name, name)
+	}
+	if ip == nil {
+		return false
+	}
+	if _, cidr, err := net.ParseCIDR(b.IP); err == nil {
+		return cidr.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(b.IP))
+}
+
+// Message is the kick message shown to a banned player.
+func (b *Ban) Message() string {
+	msg := "Banned"
+	if b.Reason != "" {
+		msg += ": " + b.Reason
+	}
+	if b.Expires != nil {
+		msg += fmt.Sprintf(" (until %s)", b.Expires.Format("2006-01-02 15:04 MST"))
+	}
+	return msg
+}
+
+func (b *Ban) String() string {
+	s := fmt.Sprintf("%s by %s", b.Target(), b.By)
+	if b.Reason != "" {
+		s += fmt.Sprintf(" (%s)", b.Reason)
+	}
+	if b.Expires != nil {
+		s += fmt.Sprintf(", expires %s", b.Expires.Format("2006-01-02 15:04 MST"))
+	}
+	return s
+}
+
+// NewBan makes a ban against target, which is either a name, an IP or a CIDR
+// range. A zero duration means the ban is permanent.
+func NewBan(target string, d time.Duration, reason, by string) (*Ban, error) {
+	b := &Ban{Reason: reason, By: by, Created: time.Now()}
+	if ip := net.ParseIP(target); ip != nil {
+		b.IP = ip.String()
+	} else if _, cidr, err := net.ParseCIDR(target); err == nil {
+		b.IP = cidr.String()
+	} else if identRegexp.MatchString(target) {
+		b.Name = target
+	} else {
+		return nil, fmt.Errorf("%q isn't a name, IP or CIDR range", target)
+	}
+	if d > 0 {
+		t := b.Created.Add(d)
+		b.Expires = &t
+	}
+	return b, nil
+}
+
+// ParseBanDuration parses a ban duration, like time.ParseDuration, but also
+// understands days ("7d") and weeks ("2w").
+func ParseBanDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * unit, nil
+	}
+	return time.ParseDuration(s)
+}
+
+////
+
+// BanList is the list of bans, persisted to a JSON file.
+type BanList struct {
+	Filename string
+
+	bans  []*Ban
+	mutex sync.Mutex
+}
+
+// Check returns the ban that applies to a player with the given name, coming
+// from the given IP, or nil if they aren't banned.
+func (l *BanList) Check(name string, ip net.IP) *Ban {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, b := range l.bans {
+		if !b.Expired() && b.Matches(name, ip) {
+			return b
+		}
+	}
+	return nil
+}
+
+// List returns the bans which haven't expired.
+func (l *BanList) List() []*Ban {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bans := []*Ban{}
+	for _, b := range l.bans {
+		if !b.Expired() {
+			bans = append(bans, b)
+		}
+	}
+	return bans
+}
+
+// Add adds a ban (replacing any existing ban on the same target), and saves the
+// list.
+func (l *BanList) Add(ban *Ban) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.remove(ban.Target())
+	l.bans = append(l.bans, ban)
+	return l.save()
+}
+
+// Remove removes the ban on a name or address, and saves the list. It returns
+// false if there was no such ban.
+func (l *BanList) Remove(target string) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.remove(target) {
+		return false, nil
+	}
+	return true, l.save()
+}
+
+func (l *BanList) remove(target string) bool {
+	for i, b := range l.bans {
+		if !strings.EqualFold(b.Target(), target) {
+			continue
+		}
+		l.bans = append(l.bans[:i], l.bans[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// save writes the list out (minus any expired bans), via a temporary file so a
+// crash can't leave it half written.
+func (l *BanList) save() error {
+	bans := []*Ban{}
+	for _, b := range l.bans {
+		if !b.Expired() {
+			bans = append(bans, b)
+		}
+	}
+	l.bans = bans
+
+	data, err := json.MarshalIndent(l.bans, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := l.Filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.Filename)
+}
+
+// LoadBanList loads the bans from a JSON file. A missing file is an empty list.
+func LoadBanList(filename string) (*BanList, error) {
+	l := &BanList{Filename: filename, bans: []*Ban{}}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.bans); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+////
+
+// Ban bans a name or address, and kicks anyone connected who matches it.
+func (ku *Kurafuto) Ban(target string, d time.Duration, reason, by string) (*Ban, error) {
+	if ku.Bans == nil {
+		return nil, errors.New("kurafuto: Bans aren't enabled")
+	}
+	ban, err := NewBan(target, d, reason, by)
+	if err != nil {
+		return nil, err
+	}
+	if err := ku.addBan(ban); err != nil {
+		return nil, err
+	}
+	WithFields(Fields{"ban": ban.Target()}).Audit().Event("ban").Infof("%s banned %s", by, ban)
+	ku.Mesh.Publish(&MeshEvent{Type: MeshBan, Ban: ban})
+	return ban, nil
+}
+
+// addBan adds a ban to the list, and kicks anyone connected who matches it.
+func (ku *Kurafuto) addBan(ban *Ban) error {
+	if err := ku.Bans.Add(ban); err != nil {
+		return err
+	}
+	for _, p := range ku.Players.Snapshot() {
+		if ban.Matches(p.Name(), p.IP()) {
+			p.Kick(ban.Message())
+		}
+	}
+	return nil
+}
+
+// Unban removes the ban on a name or address.
+func (ku *Kurafuto) Unban(target, by string) error {
+	if ku.Bans == nil {
+		return errors.New("kurafuto: Bans aren't enabled")
+	}
+	ok, err := ku.Bans.Remove(target)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("kurafuto: %s isn't banned", target)
+	}
+	WithFields(Fields{"ban": target}).Audit().Event("unban").Infof("%s unbanned %s", by, target)
+	ku.Mesh.Publish(&MeshEvent{Type: MeshUnban, Target: target, By: by})
+	return nil
+}
+
+// parseBanArgs splits "<target> [duration] [reason...]" command arguments.
+func parseBanArgs(args []string) (target string, d time.Duration, reason string) {
+	target = args[0]
+	args = args[1:]
+	if len(args) > 0 {
+		if t, err := ParseBanDuration(args[0]); err == nil {
+			d = t
+			args = args[1:]
+		}
+	}
+	reason = strings.Join(args, " ")
+	return
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/kurafuto/kyubu/packets"
+)
+
+var (
+	// captureMagic starts every capture file.
+	captureMagic = []byte("KURACAP1")
+	// captureNameRegexp matches what can't go in a capture's filename.
+	captureNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// A Capture records every packet passing through a player's parsers to a file,
+// so protocol bugs can be looked at (or reproduced) later with `kurafuto replay`.
+//
+// After the magic, a capture file is a series of records:
+//
+//	int64  nanoseconds since the Unix epoch (big endian)
+//	uint8  direction (packets.ServerBound or packets.ClientBound)
+//	uint32 length of the packet (big endian)
+//	[]byte the raw packet
+type Capture struct {
+	Filename string
+
+	f     *os.File
+	w     *bufio.Writer
+	mutex sync.Mutex
+}
+
+// Record writes a packet to the capture. Each record is flushed as it's
+// written, so a capture is readable while it's running, and nothing is lost if
+// Kurafuto dies before it's closed.
+func (c *Capture) Record(dir packets.PacketDirection, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.w == nil {
+		return errors.New("kurafuto: Capture is closed")
+	}
+
+	var head [13]byte
+	binary.BigEndian.PutUint64(head[0:8], uint64(time.Now().UnixNano()))
+	head[8] = byte(dir)
+	binary.BigEndian.PutUint32(head[9:13], uint32(len(data)))
+	if _, err := c.w.Write(head[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// Close flushes and closes the capture file.
+func (c *Capture) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.w == nil {
+		return nil
+	}
+	err := c.w.Flush()
+	c.w = nil
+	if e := c.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func NewCapture(filename string) (*Capture, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	if _, err = w.Write(captureMagic); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Capture{Filename: filename, f: f, w: w}, nil
+}
+
+// CaptureRecord is a single packet read back out of a capture file.
+type CaptureRecord struct {
+	Time      time.Time
+	Direction packets.PacketDirection
+	Data      []byte
+}
+
+// ReadCapture reads every record out of a capture file.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, captureMagic) {
+		return nil, errors.New("kurafuto: Not a capture file")
+	}
+
+	records := []CaptureRecord{}
+	for {
+		var head [13]byte
+		if _, err := io.ReadFull(br, head[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return records, err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(head[9:13]))
+		if _, err := io.ReadFull(br, data); err != nil {
+			return records, err
+		}
+		records = append(records, CaptureRecord{
+			Time:      time.Unix(0, int64(binary.BigEndian.Uint64(head[0:8]))),
+			Direction: packets.PacketDirection(head[8]),
+			Data:      data,
+		})
+	}
+	return records, nil
+}
+
+// decodeRecord parses a captured packet with Kyubu.
+func decodeRecord(rec CaptureRecord) (packets.Packet, error) {
+	return packets.NewParser(bytes.NewReader(rec.Data), rec.Direction).Next()
+}
+
+////
+
+// StartCapture starts capturing the player's packets to a new file in dir. The
+// handshake the player has already sent is written first. The file is named
+// after the player, but as they choose their own name, anything other than
+// letters, digits and underscores is replaced, so it can't escape dir.
+func (p *Player) StartCapture(dir string) error {
+	name := captureNameRegexp.ReplaceAllString(p.Name(), "_")
+	if name == "" {
+		name = "unknown"
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("%s-%s-%s.kcap", name, p.Id, time.Now().Format("20060102-150405")))
+	c, err := NewCapture(filename)
+	if err != nil {
+		return err
+	}
+	for _, packet := range p.handshake {
+		c.Record(packets.ServerBound, packet.Bytes())
+	}
+
+	p.cMutex.Lock()
+	old := p.capture
+	p.capture = c
+	p.cMutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	p.Log().Event("capture").Infof("Capturing packets for %s to %s", p.Name(), filename)
+	return nil
+}
+
+// StopCapture stops capturing the player's packets, if we were.
+func (p *Player) StopCapture() error {
+	p.cMutex.Lock()
+	c := p.capture
+	p.capture = nil
+	p.cMutex.Unlock()
+	if c == nil {
+		return nil
+	}
+	p.Log().Event("capture").Infof("Stopped capturing packets for %s (%s)", p.Name(), c.Filename)
+	return c.Close()
+}
+
+// Capture returns the player's current capture, or nil if they aren't being
+// captured.
+func (p *Player) Capture() *Capture {
+	p.cMutex.Lock()
+	defer p.cMutex.Unlock()
+	return p.capture
+}
+
+////
+
+// replayMain is the `kurafuto replay` subcommand. It pretty-prints a capture,
+// or with -server, replays the serverbound half of it against a backend and
+// prints what the backend sends back.
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	server := fs.String("server", "", "replay serverbound packets against this backend (address:port).")
+	realtime := fs.Bool("realtime", true, "keep the original timing between packets when replaying.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [-server address:port] capture.kcap\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		Warnf("%s", err)
+		return 1
+	}
+	defer f.Close()
+
+	records, err := ReadCapture(f)
+	if err != nil {
+		Warnf("Capture may be truncated: %s", err)
+	}
+	if len(records) == 0 {
+		Warnf("No packets in %s", fs.Arg(0))
+		return 1
+	}
+
+	if *server == "" {
+		start := records[0].Time
+		for _, rec := range records {
+			printRecord(rec.Time.Sub(start), rec)
+		}
+		return 0
+	}
+	if err := replay(*server, records, *realtime); err != nil {
+		Warnf("Replay failed: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// printRecord pretty-prints a single captured packet.
+func printRecord(offset time.Duration, rec CaptureRecord) {
+	arrow := "C -> S"
+	if rec.Direction == packets.ClientBound {
+		arrow = "C <- S"
+	}
+	if len(rec.Data) == 0 {
+		fmt.Printf("%12s %s (empty)\n", offset, arrow)
+		return
+	}
+	packet, err := decodeRecord(rec)
+	if err != nil {
+		fmt.Printf("%12s %s %#.2x (%d bytes, undecodable: %s)\n%s", offset, arrow, rec.Data[0], len(rec.Data), err, hex.Dump(rec.Data))
+		return
+	}
+	fmt.Printf("%12s %s %#.2x %T %+v\n", offset, arrow, packet.Id(), packet, packet)
+}
+
+// replay sends the serverbound packets of a capture to a backend, and prints
+// everything the backend sends back.
+func replay(addr string, records []CaptureRecord, realtime bool) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		parser := packets.NewParser(conn, packets.ClientBound)
+		for {
+			packet, err := parser.Next()
+			if err != nil {
+				done <- err
+				return
+			}
+			printRecord(time.Since(start), CaptureRecord{Direction: packets.ClientBound, Data: packet.Bytes()})
+		}
+	}()
+
+	last := records[0].Time
+	for _, rec := range records {
+		if rec.Direction != packets.ServerBound {
+			continue
+		}
+		if realtime {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+		printRecord(time.Since(start), rec)
+		if _, err := conn.Write(rec.Data); err != nil {
+			return err
+		}
+	}
+
+	// Give the backend a moment to respond to the last of it.
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			return err
+		}
+	case <-time.After(5 * time.Second):
+	}
+	return nil
+}
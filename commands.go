@@ -0,0 +1,453 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUsage is returned by a command's Run to have its usage shown to the player.
+var ErrUsage = errors.New("kurafuto: Bad command usage")
+
+// A Command is an edge command: something players type into chat (after the
+// command prefix) which Kurafuto handles itself, rather than passing on to their
+// server. Run is given the arguments (split at spaces) and is only called with
+// at least MinArgs of them. Any error it returns, other than ErrUsage, is shown
+// to the player. Only players in Group (or a higher one) can run it.
+type Command struct {
+	Name    string
+	Aliases []string
+	Usage   string // The arguments it takes, like "<server>".
+	Help    string // What it does, in a line.
+	MinArgs int
+	Group   Group
+
+	Run func(p *Player, args []string) error
+}
+
+// CommandRegistry holds the edge commands, by name and alias. Every method is
+// safe to call from any goroutine.
+type CommandRegistry struct {
+	commands []*Command          // In registration order.
+	names    map[string]*Command // Lowercased name or alias -> command.
+	mutex    sync.RWMutex
+}
+
+// Register adds a command. It fails if the command's name, or any of its
+// aliases, is already taken.
+func (r *CommandRegistry) Register(c *Command) error {
+	if c.Name == "" || c.Run == nil {
+		return errors.New("kurafuto: Commands need a name and a Run function")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := append([]string{c.Name}, c.Aliases...)
+	for _, name := range names {
+		if _, ok := r.names[strings.ToLower(name)]; ok {
+			return fmt.Errorf("kurafuto: Command %q is already registered", name)
+		}
+	}
+	for _, name := range names {
+		r.names[strings.ToLower(name)] = c
+	}
+	r.commands = append(r.commands, c)
+	return nil
+}
+
+// Unregister removes a command (by name or alias), returning false if there
+// was no such command.
+func (r *CommandRegistry) Unregister(name string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c, ok := r.names[strings.ToLower(name)]
+	if !ok {
+		return false
+	}
+	for n, cmd := range r.names {
+		if cmd == c {
+			delete(r.names, n)
+		}
+	}
+	for i, cmd := range r.commands {
+		if cmd == c {
+			r.commands = append(r.commands[:i:i], r.commands[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Get returns the command with the given name or alias (case insensitive), or
+// nil.
+func (r *CommandRegistry) Get(name string) *Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.names[strings.ToLower(name)]
+}
+
+// List returns every command, in the order they were registered.
+func (r *CommandRegistry) List() []*Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	commands := make([]*Command, len(r.commands))
+	copy(commands, r.commands)
+	return commands
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{commands: []*Command{}, names: map[string]*Command{}}
+}
+
+////
+
+// Command looks up an edge command by name, or by one of its aliases, either
+// built in or from the config. It returns nil if there's no such command.
+func (ku *Kurafuto) Command(name string) *Command {
+	if c := ku.Commands.Get(name); c != nil {
+		return c
+	}
+	if target, ok := ku.Config().Commands.Aliases[strings.ToLower(name)]; ok {
+		return ku.Commands.Get(target)
+	}
+	return nil
+}
+
+// CommandGroup returns the group a command needs, which the config can change.
+func (ku *Kurafuto) CommandGroup(c *Command) Group {
+	if g, ok := ku.Config().Commands.Groups[strings.ToLower(c.Name)]; ok {
+		return g
+	}
+	return c.Group
+}
+
+// commandAliases returns every alias for a command, including any from the
+// config, sorted.
+func (ku *Kurafuto) commandAliases(c *Command) []string {
+	aliases := append([]string{}, c.Aliases...)
+	for alias, target := range ku.Config().Commands.Aliases {
+		if ku.Commands.Get(target) == c {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+////
+
+// RunCommand runs a chat message as an edge command, if it starts with the
+// command prefix. It returns false if it doesn't, so the message should be sent
+// on as usual.
+func (p *Player) RunCommand(line string) bool {
+	prefix := p.ku.Config().Commands.Prefix
+	args := strings.Fields(line)
+	if len(args) == 0 || !strings.EqualFold(args[0], prefix) {
+		return false
+	}
+	if len(args) == 1 {
+		p.commandHelp(nil)
+		return true
+	}
+
+	name := args[1]
+	c := p.ku.Command(name)
+	args = args[2:]
+	switch {
+	case c == nil:
+		p.Message(fmt.Sprintf("&cThere's no command called %s. Type %s help for a list.", name, prefix))
+	case !p.canRun(c):
+		p.Message(fmt.Sprintf("&cOnly %ss can do that.", p.ku.CommandGroup(c)))
+	case len(args) < c.MinArgs:
+		p.Message(fmt.Sprintf("&cUsage: %s %s %s", prefix, c.Name, c.Usage))
+	default:
+		if p.ku.CommandGroup(c) > GroupPlayer {
+			p.Log().Audit().Event("command").Infof("%s ran %s %s", p.Name(), c.Name, strings.Join(args, " "))
+		}
+		switch err := c.Run(p, args); err {
+		case nil:
+		case ErrUsage:
+			p.Message(fmt.Sprintf("&cUsage: %s %s %s", prefix, c.Name, c.Usage))
+		default:
+			p.Message(fmt.Sprintf("&c%s", err))
+		}
+	}
+	return true
+}
+
+// canRun returns whether the player is in a group allowed to run a command.
+func (p *Player) canRun(c *Command) bool {
+	return p.ku.Config().Group(p.Name()) >= p.ku.CommandGroup(c)
+}
+
+// commandHelp tells the player about the commands they can run, or one command
+// in particular.
+func (p *Player) commandHelp(args []string) error {
+	prefix := p.ku.Config().Commands.Prefix
+	if len(args) > 0 {
+		c := p.ku.Command(args[0])
+		if c == nil || !p.canRun(c) {
+			return fmt.Errorf("There's no command called %s.", args[0])
+		}
+		p.Message(fmt.Sprintf("&5%s %s %s", prefix, c.Name, c.Usage))
+		p.Message("&5" + c.Help)
+		if aliases := p.ku.commandAliases(c); len(aliases) > 0 {
+			p.Message("&5Also known as: " + strings.Join(aliases, ", "))
+		}
+		return nil
+	}
+
+	p.Message(fmt.Sprintf("&5Commands (type %s help <command> for more):", prefix))
+	for _, c := range p.ku.Commands.List() {
+		if p.canRun(c) {
+			p.Message(fmt.Sprintf("&5- %s: %s", c.Name, c.Help))
+		}
+	}
+	return nil
+}
+
+////
+
+// builtinCommands returns Kurafuto's own edge commands.
+func builtinCommands() []*Command {
+	return []*Command{
+		{Name: "help", Aliases: []string{"?"}, Usage: "[command]", Help: "Lists commands, or explains one.", Run: (*Player).commandHelp},
+		{Name: "list", Aliases: []string{"servers"}, Help: "Lists servers, with player counts.", Run: cmdList},
+		{Name: "jump", Aliases: []string{"j", "server"}, Usage: "<server>", Help: "Moves you to another server.", MinArgs: 1, Run: cmdJump},
+		{Name: "info", Help: "Shows how many players are online.", Run: cmdInfo},
+		{Name: "msg", Aliases: []string{"tell", "whisper", "w"}, Usage: "<player> <message>", Help: "Sends a private message to a player on any server.", MinArgs: 2, Run: cmdMsg},
+		{Name: "reply", Aliases: []string{"r"}, Usage: "<message>", Help: "Answers the last private message you got.", MinArgs: 1, Run: cmdReply},
+		{Name: "ignore", Usage: "[player]", Help: "Hides a player's messages from you, or lists who you're ignoring.", Run: cmdIgnore},
+		{Name: "unignore", Usage: "<player>", Help: "Stops ignoring a player.", MinArgs: 1, Run: cmdUnignore},
+		{Name: "global", Aliases: []string{"g"}, Help: "Switches between chatting to your server, and to everyone.", Run: cmdGlobal},
+		{Name: "kick", Usage: "<player> [reason]", Help: "Kicks a player, from any server.", MinArgs: 1, Group: GroupModerator, Run: cmdKick},
+		{Name: "ban", Usage: "<name|ip|cidr> [duration] [reason]", Help: "Bans a player or address.", MinArgs: 1, Group: GroupModerator, Run: cmdBan},
+		{Name: "unban", Usage: "<name|ip|cidr>", Help: "Lifts a ban.", MinArgs: 1, Group: GroupModerator, Run: cmdUnban},
+		{Name: "send", Usage: "<player> <server>", Help: "Moves a player to another server.", MinArgs: 2, Group: GroupAdmin, Run: cmdSend},
+		{Name: "drain", Usage: "<server> [off|deadline]", Help: "Stops new players going to a server, and moves everyone off it after deadline.", MinArgs: 1, Group: GroupAdmin, Run: cmdDrain},
+		{Name: "reload", Help: "Reloads Kurafuto's config.", Group: GroupAdmin, Run: cmdReload},
+	}
+}
+
+func cmdList(p *Player, args []string) error {
+	p.Message("&5List of servers:")
+	current := p.Backend()
+	for _, b := range p.ku.Backends() {
+		count := fmt.Sprintf("%d", p.ku.NetworkCount(b))
+		if b.MaxPlayers > 0 {
+			count += fmt.Sprintf("/%d", b.MaxPlayers)
+		}
+		state := ""
+		if !b.Healthy() {
+			state = " &c(down)"
+		} else if b.Draining() {
+			state = " &e(draining)"
+		}
+		if b == current {
+			state += " &a(you're here)"
+		}
+		p.Message(fmt.Sprintf("&5- %s: %s players%s", b.Name, count, state))
+	}
+	return nil
+}
+
+func cmdJump(p *Player, args []string) error {
+	b := p.ku.Backend(args[0])
+	switch {
+	case b == nil:
+		return fmt.Errorf("There's no server called %s.", args[0])
+	case p.InLobby():
+		p.Travel(b)
+		return nil
+	case b == p.Backend():
+		return fmt.Errorf("You're already on %s.", b.Name)
+	case !b.Healthy():
+		return fmt.Errorf("%s is down right now.", b.Name)
+	case b.Draining():
+		return fmt.Errorf("%s isn't taking new players right now.", b.Name)
+	case !p.ku.AllowedOn(p.Name(), b):
+		return fmt.Errorf("You aren't whitelisted on %s.", b.Name)
+	}
+
+	// Dialing can take a while, so don't hold up the client's packets.
+	go func() {
+		err := p.Redirect(b)
+		switch {
+		case err == errBackendFull:
+			p.Message(fmt.Sprintf("&c%s is full.", b.Name))
+		case err != nil:
+			p.Log().Debugf("Unable to move %s to %s: %s", p.Name(), b.Name, err)
+			p.Message(fmt.Sprintf("&cUnable to jump to %s, try again later.", b.Name))
+		default:
+			p.Log().Infof("%s jumped to %s", p.Name(), b.Name)
+		}
+	}()
+	return nil
+}
+
+func cmdInfo(p *Player, args []string) error {
+	// TODO: add server name, motd, + basic info.
+	p.Message(fmt.Sprintf("&5%d players are online!", p.ku.NetworkOnline()))
+	if states := p.ku.Mesh.States(); len(states) > 0 {
+		p.Message(fmt.Sprintf("&5(%d here, and %d on %d other proxies)", p.ku.Players.Online(), p.ku.Mesh.Online(), len(states)))
+	}
+	return nil
+}
+
+func cmdMsg(p *Player, args []string) error {
+	sendPrivate(p, args[0], strings.Join(args[1:], " "))
+	return nil
+}
+
+// sendPrivate sends a private message for the msg and reply edge commands,
+// telling the sender if it can't be delivered.
+func sendPrivate(p *Player, to, message string) {
+	if strings.EqualFold(to, p.Name()) {
+		p.Message("&cYou can't message yourself.")
+		return
+	}
+	switch err := p.ku.PrivateMessage(p, to, message); err {
+	case nil:
+	case errOffline:
+		p.Message(fmt.Sprintf("&c%s isn't online.", to))
+	case errIgnored:
+		p.Message(fmt.Sprintf("&c%s isn't accepting messages from you.", to))
+	default:
+		p.Message(fmt.Sprintf("&cUnable to message %s: %s", to, err))
+	}
+}
+
+func cmdReply(p *Player, args []string) error {
+	to := p.lastSender()
+	if to == "" {
+		return errors.New("Nobody has messaged you yet.")
+	}
+	sendPrivate(p, to, strings.Join(args, " "))
+	return nil
+}
+
+func cmdIgnore(p *Player, args []string) error {
+	if len(args) == 0 {
+		if names := p.ku.Ignores.List(p.Name()); len(names) > 0 {
+			p.Message("&eYou're ignoring: " + strings.Join(names, ", "))
+		} else {
+			p.Message("&eYou aren't ignoring anyone.")
+		}
+		return nil
+	}
+	if strings.EqualFold(args[0], p.Name()) {
+		return errors.New("You can't ignore yourself.")
+	}
+	p.ku.Ignores.Ignore(p.Name(), args[0])
+	p.Message(fmt.Sprintf("&aYou're now ignoring %s.", args[0]))
+	return nil
+}
+
+func cmdUnignore(p *Player, args []string) error {
+	if !p.ku.Ignores.Unignore(p.Name(), args[0]) {
+		return fmt.Errorf("You aren't ignoring %s.", args[0])
+	}
+	p.Message(fmt.Sprintf("&aYou're no longer ignoring %s.", args[0]))
+	return nil
+}
+
+func cmdGlobal(p *Player, args []string) error {
+	c := p.ku.Config().Chat
+	if !c.Global {
+		return errors.New("Global chat isn't enabled.")
+	}
+	p.global = !p.global
+	if p.global {
+		p.Message("&aYou're now chatting to every server.")
+	} else {
+		p.Message(fmt.Sprintf("&aYou're now chatting to your server. Start a message with %s to chat globally.", c.Prefix))
+	}
+	return nil
+}
+
+func cmdBan(p *Player, args []string) error {
+	target, d, reason := parseBanArgs(args)
+	ban, err := p.ku.Ban(target, d, reason, p.Name())
+	if err != nil {
+		return fmt.Errorf("Unable to ban %s: %s", target, err)
+	}
+	p.Message(fmt.Sprintf("&aBanned %s", ban.Target()))
+	return nil
+}
+
+func cmdUnban(p *Player, args []string) error {
+	if err := p.ku.Unban(args[0], p.Name()); err != nil {
+		return err
+	}
+	p.Message(fmt.Sprintf("&aUnbanned %s", args[0]))
+	return nil
+}
+
+func cmdKick(p *Player, args []string) error {
+	reason := fmt.Sprintf("Kicked by %s.", p.Name())
+	if len(args) > 1 {
+		reason = strings.Join(args[1:], " ")
+	}
+	if target := p.ku.Players.Find(args[0]); target != nil {
+		target.Kick(reason)
+		p.Message(fmt.Sprintf("&aKicked %s: %s", target.Name(), reason))
+		return nil
+	}
+	if node := p.ku.Mesh.Where(args[0]); node != "" {
+		p.ku.Mesh.Publish(&MeshEvent{Type: MeshKick, Target: args[0], Reason: reason})
+		p.Message(fmt.Sprintf("&aKicked %s (on %s): %s", args[0], node, reason))
+		return nil
+	}
+	return fmt.Errorf("%s isn't online.", args[0])
+}
+
+func cmdSend(p *Player, args []string) error {
+	target := p.ku.Players.Find(args[0])
+	if target == nil {
+		return fmt.Errorf("%s isn't online here.", args[0])
+	}
+	b := p.ku.Backend(args[1])
+	switch {
+	case b == nil:
+		return fmt.Errorf("There's no server called %s.", args[1])
+	case b == target.Backend() && !target.InLobby():
+		return fmt.Errorf("%s is already on %s.", target.Name(), b.Name)
+	}
+
+	go func() {
+		if err := target.Move(b); err != nil {
+			p.Message(fmt.Sprintf("&cUnable to send %s to %s: %s", target.Name(), b.Name, err))
+			return
+		}
+		p.Message(fmt.Sprintf("&aSent %s to %s", target.Name(), b.Name))
+	}()
+	return nil
+}
+
+func cmdDrain(p *Player, args []string) error {
+	b := p.ku.Backend(args[0])
+	if b == nil {
+		return fmt.Errorf("There's no server called %s.", args[0])
+	}
+	if len(args) > 1 {
+		if d, err := time.ParseDuration(args[1]); err == nil {
+			p.Message(fmt.Sprintf("&aDraining %s in %s", b.Name, d))
+			go p.ku.DrainBackend(b, d)
+			return nil
+		}
+	}
+	draining := len(args) < 2 || strings.ToLower(args[1]) != "off"
+	b.SetDraining(draining)
+	p.Message(fmt.Sprintf("&a%s draining: %v", b.Name, draining))
+	return nil
+}
+
+func cmdReload(p *Player, args []string) error {
+	if err := p.ku.Reload(); err != nil {
+		return fmt.Errorf("Unable to reload config: %s", err)
+	}
+	p.Message("&aReloaded config.")
+	return nil
+}
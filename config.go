@@ -9,6 +9,9 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/kurafuto/kyubu/packets"
 )
 
 // packetList is special JSON type that turns a string of hexadecimal ids into
@@ -86,12 +89,164 @@ func (p *ident) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + *p + `"`), nil
 }
 
+// packetId is a JSON string holding a single hexadecimal (or decimal) packet id.
+type packetId byte
+
+func (p *packetId) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	i, err := strconv.ParseUint(str, 0, 8)
+	if err != nil {
+		return err
+	}
+	*p = packetId(i)
+	return nil
+}
+
+func (p *packetId) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%#.2x"`, byte(*p))), nil
+}
+
+// direction is a JSON string naming which way a packet travels: "client" (to
+// the client), "server" (to the server) or "both".
+type direction packets.PacketDirection
+
+func (d *direction) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	switch strings.ToLower(str) {
+	case "client":
+		*d = direction(packets.ClientBound)
+	case "server":
+		*d = direction(packets.ServerBound)
+	case "both", "":
+		*d = direction(packets.Both)
+	default:
+		return fmt.Errorf("%q is not a valid packet direction", str)
+	}
+	return nil
+}
+
+func (d *direction) MarshalJSON() ([]byte, error) {
+	switch packets.PacketDirection(*d) {
+	case packets.ClientBound:
+		return []byte(`"client"`), nil
+	case packets.ServerBound:
+		return []byte(`"server"`), nil
+	}
+	return []byte(`"both"`), nil
+}
+
+// duration is a JSON string holding a time.Duration, such as "1h30m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	if str == "" {
+		*d = 0
+		return nil
+	}
+	t, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = duration(t)
+	return nil
+}
+
+func (d *duration) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + time.Duration(*d).String() + `"`), nil
+}
+
+// Group is a permission group, which a player is in, and which an edge command
+// needs. Groups are ordered: admins can do anything moderators can, and so on.
+// In JSON, it's the group's name.
+type Group int
+
+const (
+	GroupPlayer    Group = iota // Everyone.
+	GroupModerator              // Can kick and ban players.
+	GroupAdmin                  // Can run the proxy: move players, drain servers, reload.
+)
+
+func (g Group) String() string {
+	switch g {
+	case GroupPlayer:
+		return "player"
+	case GroupModerator:
+		return "moderator"
+	case GroupAdmin:
+		return "admin"
+	}
+	return "unknown"
+}
+
+func (g *Group) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	for _, group := range []Group{GroupPlayer, GroupModerator, GroupAdmin} {
+		if strings.EqualFold(str, group.String()) {
+			*g = group
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a valid group", str)
+}
+
+func (g Group) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + g.String() + `"`), nil
+}
+
 ////////////////////
 
+// Duplicate login policies, for when a player logs in with a name that's
+// already logged in.
+const (
+	DuplicateKickOld = "kick-old" // Kick the existing session.
+	DuplicateReject  = "reject"   // Turn away the new session.
+	DuplicateAllow   = "allow"    // Let both of them be.
+)
+
+// Unknown packet policies, used when a parser reads a packet id that isn't
+// registered with Kyubu (or declared in "custom-packets").
+const (
+	UnknownKick = "kick" // Kick the player, telling them which packet it was.
+	UnknownDrop = "drop" // Log it, and drop the connection.
+	UnknownHex  = "hex"  // Log a hex dump of what we read, and drop the connection.
+)
+
+// CustomPacket declares a packet which Kurafuto should forward opaquely, such
+// as those sent by custom server plugins. Size is the full size of the packet
+// in bytes, including the packet id.
+type CustomPacket struct {
+	Id        packetId  `json:"id"`
+	Name      string    `json:"name"`
+	Size      int       `json:"size"`
+	Direction direction `json:"direction"`
+}
+
 type Server struct {
-	Name    ident  `json:"name"`
-	Address string `json:"address"`
-	Port    int    `json:"port"`
+	Name      ident  `json:"name"`
+	Address   string `json:"address"`
+	Port      int    `json:"port"`
+	Whitelist bool   `json:"whitelist"` // Only whitelisted names are sent here.
+
+	MaxPlayers int  `json:"max-players"` // Per instance, 0 means no limit.
+	NoSticky   bool `json:"no-sticky"`   // Don't send players back here by sticky session.
+}
+
+// Addr returns the server's dialable "address:port".
+func (s *Server) Addr() string {
+	return fmt.Sprintf("%s:%d", s.Address, s.Port)
 }
 
 type Config struct {
@@ -107,6 +262,266 @@ type Config struct {
 	Ignore   packetList  `json:"ignore-packets"`
 	Drop     packetList  `json:"drop-packets"`
 	DropExts commaString `json:"drop-extensions"`
+
+	CustomPackets  []CustomPacket `json:"custom-packets"`
+	UnknownPackets string         `json:"unknown-packets"`
+
+	MaxPlayers int    `json:"max-players"`
+	Public     bool   `json:"public"`
+	Metrics    string `json:"metrics-address"` // Where to serve /metrics, if set.
+
+	DuplicateLogins string `json:"duplicate-logins"`
+
+	BanFile string           `json:"ban-file"`
+	Groups  map[string]Group `json:"groups"` // Names -> the group they're in.
+
+	// Operators is from before Groups, and puts names in GroupAdmin.
+	Operators []string `json:"operators"`
+
+	Whitelist WhitelistConfig `json:"whitelist"`
+	Limits    LimitsConfig    `json:"limits"`
+
+	PacketLimits PacketLimitsConfig `json:"packet-limits"`
+
+	Drain DrainConfig `json:"drain"`
+	Queue QueueConfig `json:"queue"`
+	Lobby LobbyConfig `json:"lobby"`
+
+	Commands CommandsConfig `json:"commands"`
+
+	Chat   ChatConfig   `json:"chat"`
+	Sticky StickyConfig `json:"sticky"`
+	Mesh   MeshConfig   `json:"mesh"`
+
+	Admin   AdminConfig   `json:"admin"`
+	Logs    LogsConfig    `json:"logs"`
+	Capture CaptureConfig `json:"capture"`
+}
+
+// RateLimit configures a token bucket: Rate events a second, in bursts of up to
+// Burst. A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// LimitsConfig limits new connections, globally and per IP, and how many
+// connections an IP can have open at once (MaxPerIP, zero is unlimited).
+type LimitsConfig struct {
+	Global   RateLimit `json:"global"`
+	PerIP    RateLimit `json:"per-ip"`
+	MaxPerIP int       `json:"max-per-ip"`
+}
+
+// Actions taken when a player goes over a packet or chat limit.
+const (
+	LimitDrop = "drop" // Drop the packet.
+	LimitKick = "kick" // Kick the player.
+)
+
+// packetLimits is a JSON object of packet ids (as strings, like "0x05") to the
+// rate limit for that packet.
+type packetLimits map[byte]RateLimit
+
+func (p *packetLimits) UnmarshalJSON(data []byte) error {
+	var m map[string]RateLimit
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*p = packetLimits{}
+	for s, r := range m {
+		i, err := strconv.ParseUint(s, 0, 8)
+		if err != nil {
+			return err
+		}
+		(*p)[byte(i)] = r
+	}
+	return nil
+}
+
+func (p *packetLimits) MarshalJSON() ([]byte, error) {
+	m := map[string]RateLimit{}
+	for id, r := range *p {
+		m[fmt.Sprintf("%#.2x", id)] = r
+	}
+	return json.Marshal(m)
+}
+
+// ChatLimits configures chat spam protection: a rate limit on messages, and a
+// limit on how many times in a row (within Window) the same message can be sent.
+type ChatLimits struct {
+	RateLimit
+	Duplicates int      `json:"duplicates"`
+	Window     duration `json:"window"`
+}
+
+// PacketLimitsConfig limits how quickly each player can send each type of
+// packet, and how quickly they can chat. Action is what happens to a player who
+// goes over a limit ("drop" or "kick").
+type PacketLimitsConfig struct {
+	Action  string       `json:"action"`
+	Packets packetLimits `json:"packets"`
+	Chat    ChatLimits   `json:"chat"`
+}
+
+// WhitelistConfig configures the whitelist: where it's stored, and what players
+// who aren't on it are told while maintenance mode is on.
+type WhitelistConfig struct {
+	File    string `json:"file"`
+	Message string `json:"message"`
+}
+
+// DrainConfig configures graceful shutdowns: how long players get to finish up,
+// and what they're told when they're kicked. Classic clients can't be handed to
+// another proxy, so the message is the place to tell them where to reconnect.
+// UpgradeDeadline is how long players are left on the old process after an
+// upgrade, before they're asked to reconnect (to the new one).
+type DrainConfig struct {
+	Deadline        duration `json:"deadline"`
+	UpgradeDeadline duration `json:"upgrade-deadline"`
+	Message         string   `json:"message"`
+}
+
+// LobbyConfig configures the lobby, Kurafuto's own small world. With it
+// enabled, players who can't be sent to any server wait there (and go back there
+// if their server goes away) rather than being kicked, seeing Message while no
+// servers are up. As a hub, everyone starts there, and picks a server by walking
+// onto its portal.
+type LobbyConfig struct {
+	Enabled bool   `json:"enabled"`
+	Hub     bool   `json:"hub"`
+	Message string `json:"message"`
+}
+
+// CommandsConfig configures edge commands: the Prefix they start with, extra
+// Aliases (alias -> command name) on top of the built in ones, and Groups, which
+// change the group a command needs (command name -> group).
+type CommandsConfig struct {
+	Prefix  string            `json:"prefix"`
+	Aliases map[string]string `json:"aliases"`
+	Groups  map[string]Group  `json:"groups"`
+}
+
+// ChatConfig configures global chat, which goes to every player on every server
+// (and every mesh peer), rather than just the sender's server. Messages starting
+// with Prefix are global, as is everything said by a player who's switched to
+// global chat with ":kura global". Format lays global messages out, filling in
+// {server}, {name} and {message}.
+type ChatConfig struct {
+	Global bool   `json:"global"`
+	Prefix string `json:"prefix"`
+	Format string `json:"format"`
+}
+
+// StickyConfig configures sticky sessions: players are sent back to the server
+// they were last on, if they were there within TTL, rather than balanced.
+type StickyConfig struct {
+	Enabled bool     `json:"enabled"`
+	File    string   `json:"file"`
+	TTL     duration `json:"ttl"`
+}
+
+// MeshConfig links Kurafuto instances together. The peer protocol is served on
+// Address, and each of Peers (other instances' mesh addresses) is synced with
+// every Interval. Every instance must share the same Token. Node names this
+// instance to its peers, and defaults to the hostname and mesh port.
+type MeshConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Node     string   `json:"node"`
+	Address  string   `json:"address"`
+	Token    string   `json:"token"`
+	Peers    []string `json:"peers"`
+	Interval duration `json:"interval"`
+}
+
+// QueueConfig configures the join queue, which players wait in while every
+// server is full. Max limits how many can wait (0 means no limit), and players
+// in Priority go to the front.
+type QueueConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Interval duration `json:"interval"` // How often players are told their position.
+	Max      int      `json:"max"`
+	Priority []string `json:"priority"`
+}
+
+// HasPriority returns whether the named player jumps the join queue.
+func (c *QueueConfig) HasPriority(name string) bool {
+	for _, n := range c.Priority {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// CaptureConfig configures packet captures: where they're written, and which
+// players are captured as soon as they log in ("*" captures everyone).
+type CaptureConfig struct {
+	Dir     string   `json:"dir"`
+	Players []string `json:"players"`
+}
+
+// Wants returns whether the named player should be captured on login.
+func (c CaptureConfig) Wants(name string) bool {
+	for _, n := range c.Players {
+		if n == "*" || strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// LogConfig configures a log file. It's rotated once it reaches MaxSize
+// megabytes, and every Rotate (if set). Old files are removed after MaxAge
+// days, or once there are more than MaxBackups of them.
+type LogConfig struct {
+	File       string   `json:"file"`
+	Verbosity  int      `json:"verbosity"`
+	Format     string   `json:"format"` // "text" or "json"
+	Colors     string   `json:"colors"` // "strip" (the default) or "raw"
+	MaxSize    int      `json:"max-size"`
+	MaxAge     int      `json:"max-age"`
+	MaxBackups int      `json:"max-backups"`
+	Compress   bool     `json:"compress"`
+	Rotate     duration `json:"rotate"`
+}
+
+// LogsConfig holds the optional log files: the main log (everything that goes
+// to stderr), a chat log, and an audit log of logins, kicks and server switches.
+type LogsConfig struct {
+	Main  *LogConfig `json:"main"`
+	Chat  *LogConfig `json:"chat"`
+	Audit *LogConfig `json:"audit"`
+}
+
+// AdminConfig configures the HTTP/JSON admin API. It binds to localhost unless
+// told otherwise, and won't start without a token.
+type AdminConfig struct {
+	Enabled bool   `json:"enabled"`
+	Address string `json:"address"`
+	Token   string `json:"token"`
+}
+
+// Group returns the permission group the named player is in. Without
+// verify-names, anyone can log in under any name, so everyone is a player.
+func (c *Config) Group(name string) Group {
+	if !c.Authenticate {
+		return GroupPlayer
+	}
+	return c.Groups[strings.ToLower(name)]
+}
+
+// warnUnverified warns that groups are being ignored, if they are.
+func (c *Config) warnUnverified() {
+	if !c.Authenticate && len(c.Groups) > 0 {
+		Warnf("verify-names is off, so anyone can use any name: ignoring the %d names in \"groups\" (and \"operators\"), everyone is a player", len(c.Groups))
+	}
+}
+
+// IsStaff returns whether the named player is a moderator or an admin, who are
+// let in even when Kurafuto is full or in maintenance mode.
+func (c *Config) IsStaff(name string) bool {
+	return c.Group(name) >= GroupModerator
 }
 
 func (c *Config) Dumps() (string, error) {
@@ -128,6 +543,126 @@ func NewConfig(r io.Reader) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	if c.MaxPlayers < 1 {
+		c.MaxPlayers = 64
+	}
+	switch c.DuplicateLogins {
+	case "":
+		c.DuplicateLogins = DuplicateKickOld
+	case DuplicateKickOld, DuplicateReject, DuplicateAllow:
+	default:
+		return nil, fmt.Errorf("%q is not a valid duplicate-logins policy", c.DuplicateLogins)
+	}
+
+	switch c.PacketLimits.Action {
+	case "":
+		c.PacketLimits.Action = LimitDrop
+	case LimitDrop, LimitKick:
+	default:
+		return nil, fmt.Errorf("%q is not a valid packet limit action", c.PacketLimits.Action)
+	}
+	if c.PacketLimits.Chat.Window == 0 {
+		c.PacketLimits.Chat.Window = duration(10 * time.Second)
+	}
+
+	if c.Whitelist.File == "" {
+		c.Whitelist.File = "whitelist.json"
+	}
+	if c.Whitelist.Message == "" {
+		c.Whitelist.Message = "Down for maintenance, try again later!"
+	}
+	if c.Drain.Deadline == 0 {
+		c.Drain.Deadline = duration(30 * time.Second)
+	}
+	if c.Drain.UpgradeDeadline == 0 {
+		c.Drain.UpgradeDeadline = duration(10 * time.Minute)
+	}
+	if c.Drain.Message == "" {
+		c.Drain.Message = "Server shutting down."
+	}
+	if c.Lobby.Hub {
+		c.Lobby.Enabled = true
+	}
+	if c.Lobby.Message == "" {
+		c.Lobby.Message = "&eNo servers are reachable right now, hang tight!"
+	}
+	if c.Commands.Prefix == "" {
+		c.Commands.Prefix = ":kura"
+	}
+	aliases := map[string]string{}
+	for alias, name := range c.Commands.Aliases {
+		aliases[strings.ToLower(alias)] = name
+	}
+	c.Commands.Aliases = aliases
+	commandGroups := map[string]Group{}
+	for name, g := range c.Commands.Groups {
+		commandGroups[strings.ToLower(name)] = g
+	}
+	c.Commands.Groups = commandGroups
+
+	groups := map[string]Group{}
+	for name, g := range c.Groups {
+		groups[strings.ToLower(name)] = g
+	}
+	for _, name := range c.Operators {
+		if _, ok := groups[strings.ToLower(name)]; !ok {
+			groups[strings.ToLower(name)] = GroupAdmin
+		}
+	}
+	c.Groups = groups
+	if c.Chat.Prefix == "" {
+		c.Chat.Prefix = "!"
+	}
+	if c.Chat.Format == "" {
+		c.Chat.Format = "&7[{server}] &f{name}: {message}"
+	}
+	if c.Sticky.File == "" {
+		c.Sticky.File = "sessions.json"
+	}
+	if c.Sticky.TTL == 0 {
+		c.Sticky.TTL = duration(7 * 24 * time.Hour)
+	}
+	if c.Mesh.Address == "" {
+		c.Mesh.Address = "0.0.0.0:25590"
+	}
+	if c.Mesh.Node == "" {
+		c.Mesh.Node = meshNode(c.Mesh.Address)
+	}
+	if c.Mesh.Interval == 0 {
+		c.Mesh.Interval = duration(5 * time.Second)
+	}
+	if c.Mesh.Enabled && c.Mesh.Token == "" {
+		return nil, fmt.Errorf("the mesh needs a token")
+	}
+	if c.Queue.Interval == 0 {
+		c.Queue.Interval = duration(5 * time.Second)
+	}
+	if c.BanFile == "" {
+		c.BanFile = "bans.json"
+	}
+	if c.Capture.Dir == "" {
+		c.Capture.Dir = "captures"
+	}
+	if c.Admin.Address == "" {
+		c.Admin.Address = "127.0.0.1:25580"
+	}
+	if c.Admin.Enabled && c.Admin.Token == "" {
+		return nil, fmt.Errorf("the admin API needs a token")
+	}
+
+	switch c.UnknownPackets {
+	case "":
+		c.UnknownPackets = UnknownDrop
+	case UnknownKick, UnknownDrop, UnknownHex:
+	default:
+		return nil, fmt.Errorf("%q is not a valid unknown-packets policy", c.UnknownPackets)
+	}
+	for _, cp := range c.CustomPackets {
+		if cp.Size < 1 {
+			return nil, fmt.Errorf("custom packet %#.2x needs a size of at least 1", byte(cp.Id))
+		}
+	}
 	return &c, nil
 }
 
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// consoleHelp lists the console commands, for `help`.
+var consoleHelp = []string{
+	"&elist&r - list connected players",
+	"&ekick <name> [reason]&r - kick a player",
+	"&esend <name> <server>&r - move a player to another server",
+	"&esay <message>&r - broadcast a chat message",
+	"&eservers&r - list servers and their health",
+	"&ereload&r - reload the config file",
+	"&edrain <server> [off|deadline]&r - stop (or resume) sending new players to a server, optionally moving everyone off it after deadline",
+	"&ecapture <name> [off]&r - start (or stop) capturing a player's packets",
+	"&eban <name|ip|cidr> [duration] [reason]&r - ban a player or address",
+	"&eunban <name|ip|cidr>&r - lift a ban",
+	"&ebans&r - list bans",
+	"&ewhitelist [on|off] [server]&r - show the whitelist, or turn maintenance mode (or a server's whitelist) on or off",
+	"&ewhitelist add|remove <name...>&r - add or remove names from the whitelist",
+	"&estop [now]&r - shut down Kurafuto, after the drain deadline (or now)",
+}
+
+// Console reads admin commands line by line (usually from stdin), and runs them
+// against a Kurafuto. Output goes through the usual logging, with color codes.
+type Console struct {
+	ku *Kurafuto
+	r  io.Reader
+}
+
+// Run reads and runs commands until the reader is exhausted.
+func (c *Console) Run() {
+	scanner := bufio.NewScanner(c.r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		c.Exec(line)
+	}
+	if err := scanner.Err(); err != nil {
+		Warnf("Console stopped: %s", err)
+	}
+}
+
+func (c *Console) out(s string, v ...interface{}) {
+	Colorf(s, v...)
+}
+
+// Exec runs a single console command.
+func (c *Console) Exec(line string) {
+	bits := strings.Fields(line)
+	cmd, args := strings.ToLower(bits[0]), bits[1:]
+
+	switch cmd {
+	case "help", "?":
+		for _, h := range consoleHelp {
+			c.out(h)
+		}
+	case "list":
+		players := c.ku.Players.Snapshot()
+		c.out("&a%d players connected:", len(players))
+		for _, p := range players {
+			backend := "-"
+			if b := p.Backend(); b != nil {
+				backend = string(b.Name)
+			}
+			c.out("  &f%s&r (%s) on &e%s&r, %s, connected %s", p.Name(), p.Remote(), backend, p.State(), time.Since(p.Connected).Truncate(time.Second))
+		}
+	case "kick":
+		if len(args) < 1 {
+			c.out("&cUsage: kick <name> [reason]")
+			return
+		}
+		p := c.ku.Players.Find(args[0])
+		if p == nil {
+			c.out("&cNo player %q", args[0])
+			return
+		}
+		reason := "Kicked by an admin."
+		if len(args) > 1 {
+			reason = strings.Join(args[1:], " ")
+		}
+		p.Kick(reason)
+		c.out("&aKicked %s: %s", p.Name(), reason)
+	case "send":
+		if len(args) < 2 {
+			c.out("&cUsage: send <name> <server>")
+			return
+		}
+		p := c.ku.Players.Find(args[0])
+		if p == nil {
+			c.out("&cNo player %q", args[0])
+			return
+		}
+		b := c.ku.Backend(args[1])
+		if b == nil {
+			c.out("&cNo server %q", args[1])
+			return
+		}
+		if err := p.Move(b); err != nil {
+			c.out("&cUnable to send %s to %s: %s", p.Name(), b.Name, err)
+			return
+		}
+		c.out("&aSent %s to %s", p.Name(), b.Name)
+	case "say":
+		if len(args) < 1 {
+			c.out("&cUsage: say <message>")
+			return
+		}
+		msg := strings.Join(args, " ")
+		c.ku.Broadcast(msg)
+		c.out("&6[CONSOLE]&r %s", msg)
+	case "servers":
+		for _, b := range c.ku.Backends() {
+			state := "&aup"
+			if !b.Healthy() {
+				state = "&cdown"
+			}
+			if b.Draining() {
+				state += " &e(draining)"
+			}
+			count := fmt.Sprintf("%d", c.ku.Players.Count(b))
+			if b.MaxPlayers > 0 {
+				count += fmt.Sprintf("/%d", b.MaxPlayers)
+			}
+			c.out("  &f%s&r (%s) %s&r, %s players", b.Name, b.Addr(), state, count)
+		}
+	case "reload":
+		if err := c.ku.Reload(); err != nil {
+			c.out("&cUnable to reload config: %s", err)
+			return
+		}
+		c.out("&aReloaded config.")
+	case "drain":
+		if len(args) < 1 {
+			c.out("&cUsage: drain <server> [off|deadline]")
+			return
+		}
+		b := c.ku.Backend(args[0])
+		if b == nil {
+			c.out("&cNo server %q", args[0])
+			return
+		}
+		if len(args) > 1 {
+			if d, err := time.ParseDuration(args[1]); err == nil {
+				c.out("&aDraining %s in %s", b.Name, d)
+				go c.ku.DrainBackend(b, d)
+				return
+			}
+		}
+		draining := len(args) < 2 || strings.ToLower(args[1]) != "off"
+		b.SetDraining(draining)
+		c.out("&a%s draining: %v", b.Name, draining)
+	case "capture":
+		if len(args) < 1 {
+			c.out("&cUsage: capture <name> [off]")
+			return
+		}
+		p := c.ku.Players.Find(args[0])
+		if p == nil {
+			c.out("&cNo player %q", args[0])
+			return
+		}
+		if len(args) > 1 && strings.ToLower(args[1]) == "off" {
+			p.StopCapture()
+			c.out("&aStopped capturing %s", p.Name())
+			return
+		}
+		if err := p.StartCapture(c.ku.Config().Capture.Dir); err != nil {
+			c.out("&cUnable to capture %s: %s", p.Name(), err)
+			return
+		}
+		c.out("&aCapturing %s to %s", p.Name(), p.Capture().Filename)
+	case "ban":
+		if len(args) < 1 {
+			c.out("&cUsage: ban <name|ip|cidr> [duration] [reason]")
+			return
+		}
+		target, d, reason := parseBanArgs(args)
+		ban, err := c.ku.Ban(target, d, reason, "CONSOLE")
+		if err != nil {
+			c.out("&cUnable to ban %s: %s", target, err)
+			return
+		}
+		c.out("&aBanned %s", ban)
+	case "unban":
+		if len(args) < 1 {
+			c.out("&cUsage: unban <name|ip|cidr>")
+			return
+		}
+		if err := c.ku.Unban(args[0], "CONSOLE"); err != nil {
+			c.out("&cUnable to unban %s: %s", args[0], err)
+			return
+		}
+		c.out("&aUnbanned %s", args[0])
+	case "bans":
+		bans := c.ku.Bans.List()
+		c.out("&a%d bans:", len(bans))
+		for _, b := range bans {
+			c.out("  %s", b)
+		}
+	case "whitelist":
+		c.whitelist(args)
+	case "stop":
+		if len(args) > 0 && strings.ToLower(args[0]) == "now" {
+			c.out("&eShutting down now!")
+			go c.ku.Quit()
+			return
+		}
+		deadline := time.Duration(c.ku.Config().Drain.Deadline)
+		c.out("&eShutting down in %s!", deadline)
+		go c.ku.Drain(deadline)
+	default:
+		c.out("&cUnknown command %q, try help", cmd)
+	}
+}
+
+func (c *Console) whitelist(args []string) {
+	w := c.ku.Whitelist
+	if len(args) < 1 {
+		state := "&coff"
+		if w.Enabled() {
+			state = "&aon"
+		}
+		c.out("&eMaintenance mode is %s&r. Whitelisted: %s", state, strings.Join(w.Names(), ", "))
+		return
+	}
+
+	var err error
+	switch strings.ToLower(args[0]) {
+	case "on", "off":
+		on := strings.ToLower(args[0]) == "on"
+		if len(args) > 1 {
+			if c.ku.Backend(args[1]) == nil {
+				c.out("&cNo server %q", args[1])
+				return
+			}
+			err = w.SetServer(args[1], on)
+		} else {
+			err = w.SetEnabled(on)
+		}
+	case "add":
+		err = w.Add(args[1:]...)
+	case "remove":
+		err = w.Remove(args[1:]...)
+	default:
+		c.out("&cUsage: whitelist [on|off] [server], or whitelist add|remove <name...>")
+		return
+	}
+	if err != nil {
+		c.out("&cUnable to save the whitelist: %s", err)
+		return
+	}
+	c.out("&aWhitelist updated.")
+}
+
+func NewConsole(ku *Kurafuto, r io.Reader) *Console {
+	return &Console{ku: ku, r: r}
+}
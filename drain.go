@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// drainWarnings are the points (time left) at which players are warned that
+// they're about to be disconnected or moved.
+var drainWarnings = []time.Duration{
+	10 * time.Minute, 5 * time.Minute, 2 * time.Minute, time.Minute,
+	30 * time.Second, 10 * time.Second, 5 * time.Second, 3 * time.Second, 2 * time.Second, time.Second,
+}
+
+// countdown warns the players returned by players (with format, given the time
+// left) every so often, until deadline has passed, there's nobody left, or stop
+// is closed.
+func countdown(players func() []*Player, deadline time.Duration, format string, stop <-chan struct{}) {
+	end := time.Now().Add(deadline)
+	for {
+		left := time.Until(end)
+		if left <= 0 {
+			return
+		}
+		ps := players()
+		if len(ps) == 0 {
+			return
+		}
+		msg := fmt.Sprintf(format, left.Round(time.Second))
+		for _, p := range ps {
+			if p.State() == Idle {
+				p.Message(msg)
+			}
+		}
+
+		wait := left
+		for _, w := range drainWarnings {
+			if w < left-time.Second/2 {
+				wait = left - w
+				break
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Quit shuts Kurafuto down straight away, kicking everyone. If a drain is
+// already under way, it's cut short.
+func (ku *Kurafuto) Quit() {
+	ku.Drain(0)
+}
+
+// Drain gracefully shuts Kurafuto down: it stops accepting new players, and
+// gives the players already connected until deadline to finish up (counting
+// down in chat), before kicking anyone left with the configured drain message.
+// Once everyone's gone, ku.Done is signalled.
+func (ku *Kurafuto) Drain(deadline time.Duration) {
+	ku.drain(deadline, "&eServer shutting down in %s.", ku.Config().Drain.Message)
+}
+
+// drain does the work for Drain, and for Upgrade, warning players with warning
+// (given the time left), and kicking them with message.
+func (ku *Kurafuto) drain(deadline time.Duration, warning, message string) {
+	ku.rMut.Lock()
+	if !ku.Running {
+		if deadline == 0 && ku.hurry != nil {
+			close(ku.hurry)
+			ku.hurry = nil
+		}
+		ku.rMut.Unlock()
+		return
+	}
+	ku.Running = false
+	hurry := make(chan struct{})
+	ku.hurry = hurry
+	ku.rMut.Unlock()
+
+	// So we don't take on any new players.
+	ku.Listener.Close()
+
+	empty := ku.Players.Empty()
+	if deadline > 0 {
+		Infof("Draining %d players, shutting down in %s", ku.Players.Len(), deadline)
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-empty:
+			case <-hurry:
+			}
+			close(stop)
+		}()
+		countdown(ku.Players.Snapshot, deadline, warning, stop)
+	}
+
+	for _, p := range ku.Players.Snapshot() {
+		p.Kick(message)
+	}
+	select {
+	case <-empty:
+	case <-time.After(10 * time.Second):
+		Warnf("%d players still connected after shutting down", ku.Players.Len())
+	}
+
+	ku.storeSessions()
+
+	ku.rMut.Lock()
+	ku.hurry = nil
+	ku.rMut.Unlock()
+	ku.Done <- true
+}
+
+// DrainBackend marks a backend as draining, then gives the players on it until
+// deadline (counting down in chat) before moving them to another backend. Any
+// players who can't be moved are kicked. It blocks until it's done.
+func (ku *Kurafuto) DrainBackend(b *Backend, deadline time.Duration) {
+	b.SetDraining(true)
+	players := func() []*Player {
+		return ku.Players.OnBackend(b)
+	}
+	Infof("Draining %d players from %s in %s", len(players()), b.Name, deadline)
+	countdown(players, deadline, fmt.Sprintf("&e%s is shutting down in %%s.", b.Name), nil)
+
+	for _, p := range players() {
+		to := ku.Pick(p)
+		if to == nil {
+			p.Kick(fmt.Sprintf("%s is shutting down.", b.Name))
+			continue
+		}
+		if err := p.Redirect(to); err != nil {
+			p.Log().Debugf("Unable to move %s to %s: %s", p.Name(), to.Name, err)
+			p.Kick(fmt.Sprintf("%s is shutting down.", b.Name))
+			continue
+		}
+		p.Message(fmt.Sprintf("&eYou've been moved to %s.", to.Name))
+	}
+}
@@ -3,6 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type Heartbeat interface {
@@ -20,16 +25,67 @@ func (h *ClassiCube) Name() string {
 	return "ClassiCube"
 }
 
+// Pump sends a heartbeat, returning the server's play URL (which is what
+// ClassiCube responds with).
 func (h *ClassiCube) Pump() (string, error) {
-	// TODO
-	return "", errors.New("Not implemented")
+	resp, err := http.Get(h.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("kurafuto: Heartbeat returned %s", resp.Status)
+	}
+	u := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(u, "http") {
+		// ClassiCube responds 200 with an error message in the body.
+		return "", errors.New(u)
+	}
+	return u, nil
 }
 
 func (h *ClassiCube) String() string {
-	// TODO
-	return fmt.Sprintf(`http://www.classicube.net/`)
+	c := h.ku.Config()
+	v := url.Values{}
+	v.Set("name", c.Name)
+	v.Set("port", fmt.Sprintf("%d", c.Port))
+	v.Set("users", fmt.Sprintf("%d", h.ku.NetworkOnline()))
+	v.Set("max", fmt.Sprintf("%d", c.MaxPlayers))
+	v.Set("public", fmt.Sprintf("%v", c.Public))
+	v.Set("version", "7")
+	v.Set("salt", h.ku.salt)
+	v.Set("software", "Kurafuto")
+	return `http://www.classicube.net/heartbeat.jsp?` + v.Encode()
 }
 
 func NewClassiCube(ku *Kurafuto) *ClassiCube {
 	return &ClassiCube{ku}
 }
+
+// PumpHeartbeats pumps the given heartbeat every interval, until Kurafuto stops
+// running.
+func PumpHeartbeats(ku *Kurafuto, h Heartbeat, interval time.Duration) {
+	for {
+		ku.rMut.Lock()
+		running := ku.Running
+		ku.rMut.Unlock()
+		if !running {
+			return
+		}
+
+		u, err := h.Pump()
+		if err != nil {
+			metricHeartbeats.WithLabelValues(h.Name(), "failure").Inc()
+			Warnf("%s heartbeat failed: %s", h.Name(), err)
+		} else {
+			metricHeartbeats.WithLabelValues(h.Name(), "success").Inc()
+			Debugf("%s heartbeat: %s", h.Name(), u)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -2,25 +2,28 @@ package main
 
 import (
 	"fmt"
+	"github.com/kurafuto/kyubu/cpe"
 	"github.com/kurafuto/kyubu/modern/minimal"
 	"github.com/kurafuto/kyubu/packets"
 	"strings"
+	"time"
 )
 
-// LogMessage is an example hook function that simply logs all message packets
-// that pass through Kurafuto. It's not that interesting, honestly.
+// LogMessage is a hook function that simply logs all message packets that pass
+// through Kurafuto to the chat log. It's registered on every player if a chat log
+// is configured.
 //
-//   parser := NewParser(...)
-//   parser.Register(packets.Message{}, LogMessage)
+//	parser := NewParser(...)
+//	parser.Register(packets.Message{}, LogMessage)
 func LogMessage(p *Player, dir packets.PacketDirection, packet packets.Packet) bool {
 	var msg *classic.Message
 	msg = packet.(*classic.Message)
 	if dir == packets.ServerBound {
-		Log(Colorify(fmt.Sprintf("&f<%s>&r %s", p.Name, msg.Message)))
+		p.Log().Chat().Event("chat").Colorf("&f<%s>&r %s", p.Name(), msg.Message)
 	} else if dir == packets.ClientBound {
-		Log(Colorify(fmt.Sprintf("&6[SERVER]&r %s", msg.Message)))
+		p.Log().Chat().Event("chat").Colorf("&6[SERVER]&r %s", msg.Message)
 	} else {
-		Warnf("LogMessage for %s, direction is: %d", p.Name, dir)
+		p.Log().Warnf("LogMessage for %s, direction is: %d", p.Name(), dir)
 	}
 	return false
 }
@@ -28,72 +31,181 @@ func LogMessage(p *Player, dir packets.PacketDirection, packet packets.Packet) b
 // DropPacket is a simple hook which will "skip" dropped packets included in the
 // server's drop list (including dropped CPE extensions).
 func DropPacket(p *Player, dir packets.PacketDirection, packet packets.Packet) (drop bool) {
-	if Ku == nil || Ku.Config == nil {
+	if Ku == nil || Ku.Config() == nil {
 		drop = false
 		return
 	}
-	for _, id := range Ku.Config.Drop {
+	rule := ""
+	for _, id := range Ku.Config().Drop {
 		if id != packet.Id() {
 			continue
 		}
 		drop = true
+		rule = fmt.Sprintf("%#.2x", id)
 		break
 	}
 	if ep, ok := packet.(cpe.ExtPacket); !drop && ok {
-		for _, ext := range Ku.Config.DropExts {
+		for _, ext := range Ku.Config().DropExts {
 			if ext != ep.String() {
 				continue
 			}
 			drop = true
+			rule = ext
 			break
 		}
 	}
 	if drop {
-		Debugf("(%s) %s dropped packet %#.2x", p.Id, p.Name, packet.Id())
+		metricDropped.WithLabelValues(rule).Inc()
+		p.Log().Event("drop").Debugf("%s dropped packet %#.2x", p.Name(), packet.Id())
 	}
 	return
 }
 
-////
+// RecordHandshake is a client hook which keeps hold of the packets a player
+// sends while identifying, so they can be replayed to another server if the
+// player is redirected.
+func RecordHandshake(p *Player, dir packets.PacketDirection, packet packets.Packet) bool {
+	if p.State() == Idle || len(p.handshake) >= 256 {
+		return false
+	}
+	switch packet.Id() {
+	case 0x00, 0x10, 0x11: // Identification, ExtInfo, ExtEntry
+		p.handshake = append(p.handshake, packet)
+	}
+	return false
+}
 
-const (
-	commandPrefix = ":kura"
-	commandHelp   = "&5Type :kura list or :kura jump <server>"
-)
+// DropHandshake is a server hook used after a redirect, which drops the new
+// server's CPE negotiation, since the client has already been through it.
+func DropHandshake(p *Player, dir packets.PacketDirection, packet packets.Packet) bool {
+	switch packet.Id() {
+	case 0x10, 0x11: // ExtInfo, ExtEntry
+		return true
+	}
+	return false
+}
 
-func EdgeCommand(p *Player, dir packets.PacketDirection, packet packets.Packet) (drop bool) {
-	if dir != packets.ServerBound || Ku == nil || Ku.Config == nil || !Ku.Config.EdgeCommands {
-		return
+// TrackDisconnect is a server hook which notes when a server kicks a player, so
+// they aren't caught by the lobby when it closes the connection.
+func TrackDisconnect(p *Player, dir packets.PacketDirection, packet packets.Packet) bool {
+	p.kicked = true
+	return false
+}
+
+// TrackTextColor is a server hook which learns CPE TextColors codes from the
+// SetTextColor packets servers send, so they can be rendered in logs (and let
+// through SanitizeColors).
+func TrackTextColor(p *Player, dir packets.PacketDirection, packet packets.Packet) bool {
+	if packet.Id() != 0x27 {
+		return false
+	}
+	// SetTextColor: id, red, green, blue, alpha, code
+	if b := packet.Bytes(); len(b) >= 6 {
+		SetCustomColor(b[5], b[1], b[2], b[3])
 	}
+	return false
+}
 
-	var bits []string
+// overLimit deals with a player going over a packet limit, according to the
+// configured action. It always drops the packet.
+func overLimit(p *Player, label, warning string) bool {
+	action := Ku.Config().PacketLimits.Action
+	metricLimited.WithLabelValues(label, action).Inc()
+	if action == LimitKick {
+		p.Log().Event("limit").Infof("Kicking %s (%s), over the %s limit", p.Name(), p.Remote(), label)
+		p.Kick(warning)
+		return true
+	}
+	p.Log().Event("limit").Debugf("%s is over the %s limit", p.Name(), label)
+	return true
+}
 
-	if msg, ok := packet.(*classic.Message); ok {
-		bits = strings.Split(msg.Message, " ")
-	} else {
-		return
+// LimitPackets is a client hook which enforces the per-player rate limits on
+// each type of packet.
+func LimitPackets(p *Player, dir packets.PacketDirection, packet packets.Packet) bool {
+	if dir != packets.ServerBound || Ku == nil || Ku.Config() == nil {
+		return false
+	}
+	b, ok := p.limits[packet.Id()]
+	if !ok || b.Allow() {
+		return false
 	}
+	return overLimit(p, fmt.Sprintf("%#.2x", packet.Id()), "You're sending too many packets!")
+}
 
-	if len(bits) < 1 || bits[0] != commandPrefix {
-		return
+// LimitChat is a client hook which protects against chat spam: it limits how
+// quickly a player can chat, and how many times in a row they can repeat
+// themselves.
+func LimitChat(p *Player, dir packets.PacketDirection, packet packets.Packet) bool {
+	if dir != packets.ServerBound || Ku == nil || Ku.Config() == nil {
+		return false
+	}
+	msg, ok := packet.(*classic.Message)
+	if !ok {
+		return false
+	}
+	limits := Ku.Config().PacketLimits.Chat
+
+	if !p.chat.Allow() {
+		if Ku.Config().PacketLimits.Action != LimitKick {
+			p.Message("&cYou're chatting too fast, slow down!")
+		}
+		return overLimit(p, "chat", "Kicked for spamming!")
+	}
+
+	if limits.Duplicates > 0 {
+		now := time.Now()
+		if strings.EqualFold(msg.Message, p.lastChat) && now.Sub(p.lastTime) < time.Duration(limits.Window) {
+			p.dupes++
+		} else {
+			p.dupes = 1
+		}
+		p.lastChat, p.lastTime = msg.Message, now
+
+		if p.dupes > limits.Duplicates {
+			if Ku.Config().PacketLimits.Action != LimitKick {
+				p.Message("&cDon't repeat yourself!")
+			}
+			return overLimit(p, "duplicate", "Kicked for spamming!")
+		}
 	}
+	return false
+}
 
-	switch bits[1] {
-	case "list":
-		msg, _ := classic.NewMessage(127, "&5List of servers:")
-		// TODO: for _, server := range Ku.Config.Servers {}
-		p.Client.C <- msg
-	case "info":
-		// TODO: add server name, motd, + basic info.
-		message := fmt.Sprintf("&5%d players are online!", len(Ku.Players))
-		msg, _ := classic.NewMessage(127, message)
-		p.Client.C <- msg
-	case "help":
-		msg, _ := classic.NewMessage(127, commandHelp)
-		p.Client.C <- msg
-	default:
-		msg, _ := classic.NewMessage(127, commandHelp)
-		p.Client.C <- msg
+// GlobalChat is a client hook which sends chat to every player on every server,
+// rather than just the sender's, if it starts with the global chat prefix, or
+// the player has switched to global chat.
+func GlobalChat(p *Player, dir packets.PacketDirection, packet packets.Packet) bool {
+	c := p.ku.Config().Chat
+	msg, ok := packet.(*classic.Message)
+	if dir != packets.ServerBound || !ok || !c.Global {
+		return false
+	}
+	text := msg.Message
+	if strings.HasPrefix(text, c.Prefix) {
+		text = strings.TrimSpace(strings.TrimPrefix(text, c.Prefix))
+	} else if !p.global || strings.HasPrefix(text, "/") {
+		// Commands are for the server, even in global chat.
+		return false
+	}
+	if text != "" {
+		p.ku.GlobalChat(p, text)
 	}
 	return true
 }
+
+////
+
+// EdgeCommand is a client hook which runs edge commands: chat messages starting
+// with the command prefix, which Kurafuto handles itself rather than passing on
+// to the player's server.
+func EdgeCommand(p *Player, dir packets.PacketDirection, packet packets.Packet) bool {
+	if dir != packets.ServerBound || Ku == nil || Ku.Config() == nil || !Ku.Config().EdgeCommands {
+		return false
+	}
+	msg, ok := packet.(*classic.Message)
+	if !ok {
+		return false
+	}
+	return p.RunCommand(msg.Message)
+}
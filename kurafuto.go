@@ -4,57 +4,62 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/dchest/uniuri"
-	"github.com/kurafuto/kyubu/modern/minimal"
 )
 
 type Kurafuto struct {
-	Players []*Player
-	mutex   sync.Mutex
+	Players *Registry
 
 	salt string
 	Name string
 	Motd string
 
-	Hub    *Server
-	Config *Config
+	Hub        *Server
+	config     *Config
+	ConfigFile string       // Where the config was loaded from, for Reload.
+	cMut       sync.RWMutex // Guards Hub and config, which Reload swaps.
+
+	backends []*Backend
+	lobby    *Lobby
+	bMut     sync.Mutex
+
+	Bans      *BanList
+	Whitelist *Whitelist
+	Limiter   *ConnLimiter
+	Sessions  *SessionStore
+	Queue     *JoinQueue
+	Ignores   *IgnoreList
+	Commands  *CommandRegistry
+	Mesh      *Mesh // nil unless the mesh is enabled.
 
 	Listener net.Listener
 	Done     chan bool
 	Running  bool
+	hurry    chan struct{} // Closed to cut a drain short.
+	upgraded bool          // Whether we've handed over to a new process.
 
 	rMut sync.Mutex
 }
 
-func (ku *Kurafuto) Quit() {
-	ku.rMut.Lock()
-	if !ku.Running {
-		ku.rMut.Unlock()
-		return
-	}
-
-	ku.Running = false
-	ku.rMut.Unlock()
-
-	// So we don't take on any new players.
-	ku.Listener.Close()
-	for len(ku.Players) > 0 {
-		for _, p := range ku.Players {
-			disc, _ := classic.NewDisconnectPlayer("Server shutting down.")
-			p.Client.C <- disc
-			p.Quit()
-		}
-	}
-	ku.Done <- true
-}
-
 func (ku *Kurafuto) Run() {
 	ku.rMut.Lock()
 	ku.Running = true
 	ku.rMut.Unlock()
 
+	go ku.checkBackends(15 * time.Second)
+	go ku.Queue.run(time.Duration(ku.Config().Queue.Interval))
+	go ku.saveSessions(time.Minute)
+	if ku.Mesh != nil {
+		go ku.Mesh.run()
+	}
+	if ku.Config().Heartbeat {
+		go PumpHeartbeats(ku, NewClassiCube(ku), 45*time.Second)
+	}
+
 	for {
 		ku.rMut.Lock()
 		if !ku.Running {
@@ -64,47 +69,129 @@ func (ku *Kurafuto) Run() {
 		ku.rMut.Unlock()
 
 		c, err := ku.Listener.Accept()
-		if err != nil && !ku.Running {
-			break
-		} else if err != nil {
+		if err != nil {
+			ku.rMut.Lock()
+			running := ku.Running
+			ku.rMut.Unlock()
+			if !running {
+				break
+			}
 			Fatal(err)
 		}
 
+		ip := connIP(c)
+		if err := ku.Limiter.Accept(ip); err != nil {
+			e := err.(*LimitError)
+			metricRejected.WithLabelValues(e.Reason).Inc()
+			Infof("Rejected connection from %s: %s", c.RemoteAddr().String(), e.Reason)
+			go reject(c, e.Message)
+			continue
+		}
+
 		p, err := NewPlayer(c, ku)
 		if err != nil {
+			ku.Limiter.Release(ip)
 			c.Close()
 			continue
 		}
-		ku.Players = append(ku.Players, p)
+		n := ku.Players.Add(p)
+		metricAccepted.Inc()
 
-		Infof("New connection from %s (%d clients)", c.RemoteAddr().String(), len(ku.Players))
-		Debugf("(%s) New connection from %s", p.Id, c.RemoteAddr().String())
+		p.Log().Event("connect").Infof("New connection from %s (%d clients)", c.RemoteAddr().String(), n)
 
 		go p.Parse()
 	}
 }
 
 func (ku *Kurafuto) Remove(p *Player) bool {
-	ku.mutex.Lock()
-	defer ku.mutex.Unlock()
-	for i, player := range ku.Players {
-		if player != p {
+	if !ku.Players.Remove(p) {
+		return false
+	}
+	p.Quit() // just in case
+	ku.Limiter.Release(p.IP().String())
+	f := "%s (%s) disconnected"
+	if p.Name() == "" {
+		f = "%s(%s) disconnected"
+	}
+	p.Log().Event("disconnect").Infof(f, p.Name(), p.Remote())
+	p.Log().Debugf("%s disconnected (%d clients)", p.Remote(), ku.Players.Len())
+	return true
+}
+
+// Broadcast sends a chat message to every player that has made it past
+// identification, on every server, and on every mesh peer.
+func (ku *Kurafuto) Broadcast(message string) {
+	ku.chat(message, "")
+}
+
+// chat is Broadcast for a message from a player (named by from, if it is), which
+// players ignoring them won't see.
+func (ku *Kurafuto) chat(message, from string) {
+	ku.broadcast(message, from)
+	ku.Mesh.Publish(&MeshEvent{Type: MeshChat, Message: message, By: from})
+}
+
+// broadcast sends a chat message to every player here.
+func (ku *Kurafuto) broadcast(message, from string) {
+	for _, p := range ku.Players.Snapshot() {
+		if s := p.State(); s == Connecting || s == Disconnected {
 			continue
 		}
-		p.Quit() // just in case
-		// Remove and zero player to allow GC to collect it.
-		copy(ku.Players[i:], ku.Players[i+1:])
-		ku.Players[len(ku.Players)-1] = nil
-		ku.Players = ku.Players[:len(ku.Players)-1]
-		f := "%s (%s) disconnected"
-		if p.Name == "" {
-			f = "%s(%s) disconnected"
+		if from != "" && ku.Ignores.Ignoring(p.Name(), from) {
+			continue
 		}
-		Infof(f, p.Name, p.Remote())
-		Debugf("(%s) %s disconnected from slot %d", p.Id, p.Remote(), i)
-		return true
+		p.Message(message)
 	}
-	return false
+}
+
+// GlobalChat sends a player's message to everyone, wherever they are, laid out
+// by the global chat format.
+func (ku *Kurafuto) GlobalChat(p *Player, message string) {
+	server := "Lobby"
+	if b := p.Backend(); b != nil && !p.InLobby() {
+		server = string(b.Name)
+	}
+	r := strings.NewReplacer("{server}", server, "{name}", p.Name(), "{message}", message)
+	ku.chat(r.Replace(ku.Config().Chat.Format), p.Name())
+}
+
+// Config returns the current config. Reload swaps it for a new one, so hold
+// on to the result rather than calling Config again if you need a consistent
+// view of it.
+func (ku *Kurafuto) Config() *Config {
+	ku.cMut.RLock()
+	defer ku.cMut.RUnlock()
+	return ku.config
+}
+
+// Reload re-reads the config file, and applies it. Changes to the listening
+// address and port need a restart to take effect, as do changes to the
+// connection limits, ban file and whitelist file (the ConnLimiter, BanList and
+// Whitelist are only made at startup, and keep their state across a reload).
+// Custom packets can be added, but not changed or removed.
+func (ku *Kurafuto) Reload() error {
+	config, err := NewConfigFile(ku.ConfigFile)
+	if err != nil {
+		return err
+	}
+	if len(config.Servers) < 1 {
+		return errors.New("kurafuto: Need at least 1 server in config.")
+	}
+	if err := RegisterCustomPackets(config.CustomPackets); err != nil {
+		return err
+	}
+	if old := ku.Config(); config.Address != old.Address || config.Port != old.Port {
+		Warnf("Listening address changed to %s:%d, this needs a restart", config.Address, config.Port)
+	}
+
+	ku.setBackends(config.Servers)
+	ku.cMut.Lock()
+	ku.Hub = &config.Servers[0]
+	ku.config = config
+	ku.cMut.Unlock()
+	Infof("Reloaded config from %s (%d servers)", ku.ConfigFile, len(config.Servers))
+	config.warnUnverified()
+	return nil
 }
 
 func NewKurafuto(config *Config) (ku *Kurafuto, err error) {
@@ -113,21 +200,53 @@ func NewKurafuto(config *Config) (ku *Kurafuto, err error) {
 		return
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.Address, config.Port))
+	if err = RegisterCustomPackets(config.CustomPackets); err != nil {
+		return
+	}
+
+	bans, err := LoadBanList(config.BanFile)
+	if err != nil {
+		return
+	}
+
+	whitelist, err := LoadWhitelist(config.Whitelist.File)
+	if err != nil {
+		return
+	}
+
+	sessions, err := LoadSessions(config.Sticky.File)
+	if err != nil {
+		return
+	}
+
+	listener, err := listen("kurafuto", fmt.Sprintf("%s:%d", config.Address, config.Port))
 	if err != nil {
 		return
 	}
 
 	ku = &Kurafuto{
-		Players:  []*Player{},
-		mutex:    sync.Mutex{},
-		salt:     uniuri.New(),
-		Hub:      &config.Servers[0],
-		Config:   config,
-		Listener: listener,
-		Done:     make(chan bool, 1),
+		Players:   NewRegistry(),
+		salt:      uniuri.New(),
+		Hub:       &config.Servers[0],
+		config:    config,
+		Bans:      bans,
+		Whitelist: whitelist,
+		Sessions:  sessions,
+		Ignores:   NewIgnoreList(),
+		Commands:  NewCommandRegistry(),
+		Limiter:   NewConnLimiter(config.Limits),
+		Listener:  listener,
+		Done:      make(chan bool, 1),
 
 		rMut: sync.Mutex{},
 	}
+	ku.Queue = NewJoinQueue(ku)
+	for _, c := range builtinCommands() {
+		ku.Commands.Register(c)
+	}
+	if config.Mesh.Enabled {
+		ku.Mesh = NewMesh(ku)
+	}
+	ku.setBackends(config.Servers)
 	return
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"sync"
+
+	"github.com/kurafuto/kyubu/modern/minimal"
+	"github.com/kurafuto/kyubu/packets"
+)
+
+// Block ids used in the levels Kurafuto generates.
+const (
+	BlockAir     byte = 0
+	BlockGrass   byte = 2
+	BlockDirt    byte = 3
+	BlockBedrock byte = 7
+)
+
+// Level is a classic level which Kurafuto can send to players itself, without a
+// backend, for things like the join queue's waiting room.
+type Level struct {
+	X, Y, Z int16  // Width, height and length.
+	Blocks  []byte // Indexed by (y*Z + z)*X + x.
+
+	SpawnX, SpawnY, SpawnZ int16 // Where players are put, in blocks.
+
+	chunks []packets.Packet // Encoded level data, made on first use.
+	once   sync.Once
+	err    error
+}
+
+// Get returns a block, or air for coordinates outside the level.
+func (l *Level) Get(x, y, z int16) byte {
+	if x < 0 || y < 0 || z < 0 || x >= l.X || y >= l.Y || z >= l.Z {
+		return BlockAir
+	}
+	return l.Blocks[(int(y)*int(l.Z)+int(z))*int(l.X)+int(x)]
+}
+
+// Set sets a block, ignoring coordinates outside the level.
+func (l *Level) Set(x, y, z int16, block byte) {
+	if x < 0 || y < 0 || z < 0 || x >= l.X || y >= l.Y || z >= l.Z {
+		return
+	}
+	l.Blocks[(int(y)*int(l.Z)+int(z))*int(l.X)+int(x)] = block
+}
+
+// encode gzips the level (prefixed with its block count, as clients expect) and
+// splits it into LevelDataChunk packets.
+func (l *Level) encode() ([]packets.Packet, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := binary.Write(gz, binary.BigEndian, int32(len(l.Blocks))); err != nil {
+		return nil, err
+	}
+	if _, err := gz.Write(l.Blocks); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	data := buf.Bytes()
+	chunks := []packets.Packet{}
+	for i := 0; i < len(data); i += 1024 {
+		end := i + 1024
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := make([]byte, 1024)
+		copy(chunk, data[i:end])
+		packet, err := classic.NewLevelDataChunk(int16(end-i), chunk, byte(end*100/len(data)))
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, packet)
+	}
+	return chunks, nil
+}
+
+// Packets returns everything a client needs to be sent to load the level (as
+// though it had just connected to a server called name) and spawn in it.
+func (l *Level) Packets(name, motd string) ([]packets.Packet, error) {
+	l.once.Do(func() {
+		l.chunks, l.err = l.encode()
+	})
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	list := []packets.Packet{}
+	ident, err := classic.NewIdentification(0x07, name, motd, 0x00)
+	if err != nil {
+		return nil, err
+	}
+	init, err := classic.NewLevelInitialize()
+	if err != nil {
+		return nil, err
+	}
+	list = append(list, ident, init)
+	list = append(list, l.chunks...)
+
+	final, err := classic.NewLevelFinalize(l.X, l.Y, l.Z)
+	if err != nil {
+		return nil, err
+	}
+	// Player positions are fixed point (32 units to a block), and at eye level.
+	spawn, err := classic.NewSpawnPlayer(-1, name, l.SpawnX*32+16, l.SpawnY*32+51, l.SpawnZ*32+16, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return append(list, final, spawn), nil
+}
+
+// Send sends a player to the level.
+func (l *Level) Send(p *Player, name, motd string) error {
+	list, err := l.Packets(name, motd)
+	if err != nil {
+		return err
+	}
+	for _, packet := range list {
+		p.Send(packet)
+	}
+	return nil
+}
+
+// NewFlatLevel makes a flat level: bedrock, dirt and then grass up to ground,
+// with air above, and players spawning in the middle.
+func NewFlatLevel(x, y, z, ground int16) *Level {
+	l := &Level{X: x, Y: y, Z: z, Blocks: make([]byte, int(x)*int(y)*int(z))}
+	for i := int16(0); i < x; i++ {
+		for k := int16(0); k < z; k++ {
+			for j := int16(0); j <= ground && j < y; j++ {
+				block := BlockDirt
+				if j == 0 {
+					block = BlockBedrock
+				} else if j == ground {
+					block = BlockGrass
+				}
+				l.Set(i, j, k, block)
+			}
+		}
+	}
+	l.SpawnX, l.SpawnY, l.SpawnZ = x/2, ground+1, z/2
+	return l
+}
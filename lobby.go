@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/kurafuto/kyubu/modern/minimal"
+	"github.com/kurafuto/kyubu/packets"
+)
+
+// Wool blocks, and matching chat colors, used for the lobby's portals. There's
+// one portal per backend, so the lobby has portals for the first few.
+var portalColors = []struct {
+	Block byte
+	Color string
+}{
+	{21, "&c"}, {22, "&6"}, {23, "&e"}, {25, "&2"}, {28, "&b"},
+	{29, "&9"}, {32, "&5"}, {34, "&d"}, {36, "&f"},
+}
+
+// A portal is a pad in the lobby which sends players who walk onto it to a
+// backend.
+type portal struct {
+	Block   byte
+	Color   string
+	Backend *Backend
+}
+
+// Lobby is Kurafuto's own world. It's where players wait in the join queue, or
+// in limbo while no server can be reached, and (as a hub) where they pick a
+// server, by walking onto its portal.
+type Lobby struct {
+	*Level
+	portals []portal
+}
+
+// Portal returns the backend whose portal a player is standing on, given their
+// (fixed point, eye level) position, or nil.
+func (l *Lobby) Portal(x, y, z int16) *Backend {
+	block := l.Get(x/32, (y-51)/32-1, z/32)
+	if block == BlockAir {
+		return nil
+	}
+	for _, pt := range l.portals {
+		if pt.Block == block {
+			return pt.Backend
+		}
+	}
+	return nil
+}
+
+// Describe returns chat messages explaining the portals.
+func (l *Lobby) Describe() []string {
+	if len(l.portals) == 0 {
+		return nil
+	}
+	msgs := []string{"&eWalk onto a pad to join a server:"}
+	for _, pt := range l.portals {
+		msgs = append(msgs, fmt.Sprintf("%s- %s", pt.Color, pt.Backend.Name))
+	}
+	return msgs
+}
+
+// NewLobby makes a small flat lobby, with a row of portals to the backends.
+func NewLobby(backends []*Backend) *Lobby {
+	n := len(backends)
+	if n > len(portalColors) {
+		n = len(portalColors)
+	}
+	width := int16(16)
+	if w := int16(4*n + 4); w > width {
+		width = w
+	}
+
+	const ground = 4
+	l := &Lobby{Level: NewFlatLevel(width, 16, 16, ground)}
+	for i := 0; i < n; i++ {
+		c := portalColors[i]
+		x := int16(2 + 4*i)
+		for dx := int16(0); dx < 3; dx++ {
+			for z := int16(2); z < 5; z++ {
+				l.Set(x+dx, ground, z, c.Block)
+			}
+		}
+		l.portals = append(l.portals, portal{c.Block, c.Color, backends[i]})
+	}
+	l.SpawnZ = 10
+	return l
+}
+
+// Lobby returns Kurafuto's own world, with portals to the current backends.
+func (ku *Kurafuto) Lobby() *Lobby {
+	ku.bMut.Lock()
+	defer ku.bMut.Unlock()
+	return ku.lobby
+}
+
+////
+
+// InLobby returns whether the player is in the lobby (queued, or in limbo),
+// rather than on a backend.
+func (p *Player) InLobby() bool {
+	s := p.State()
+	return s == Queued || s == Limbo
+}
+
+// hold sends the player to the lobby, in the given state (Queued or Limbo), with
+// a status message. It's up to the caller to deal with the player's server
+// connection (or lack of one), and to keep reading from the client.
+func (p *Player) hold(state PlayerState, status string) error {
+	lobby := p.ku.Lobby()
+	p.SetState(state)
+	p.portal = nil
+	if err := lobby.Send(p, p.ku.Config().Name, p.ku.Config().Motd); err != nil {
+		return err
+	}
+	p.Message(status)
+	if state == Queued {
+		pos := p.ku.Queue.Add(p)
+		p.Log().Event("queued").Infof("%s (%s) is #%d in queue", p.Name(), p.Remote(), pos)
+		p.Message(fmt.Sprintf("&eYou are #%d in queue.", pos))
+	}
+	for _, msg := range lobby.Describe() {
+		p.Message(msg)
+	}
+	return nil
+}
+
+// dropCPE stops the player from using CPE for the rest of the session, by
+// taking the CPE magic out of their handshake. Kurafuto doesn't negotiate CPE
+// in the lobby, so a client which starts there doesn't expect it.
+func (p *Player) dropCPE() error {
+	if !p.CPE() {
+		return nil
+	}
+	ident, err := classic.NewIdentification(p.ident.ProtocolVersion, p.ident.Name, p.ident.KeyMotd, 0x00)
+	if err != nil {
+		return err
+	}
+	p.handshake = []packets.Packet{ident}
+	p.tMutex.Lock()
+	p.cpe = false
+	p.tMutex.Unlock()
+	return nil
+}
+
+// Move sends a player to a backend on someone else's say-so (/send, the console
+// or the admin API): with Travel if they're in the lobby, or Redirect if they're
+// on another server.
+func (p *Player) Move(b *Backend) error {
+	if p.InLobby() {
+		p.Travel(b)
+		return nil
+	}
+	return p.Redirect(b)
+}
+
+// Travel sends a player in the lobby on to a backend, if it'll have them. If
+// the backend can't be reached, they stay where they are.
+func (p *Player) Travel(b *Backend) {
+	switch {
+	case !b.Healthy():
+		p.Message(fmt.Sprintf("&c%s is down right now.", b.Name))
+		return
+	case b.Draining():
+		p.Message(fmt.Sprintf("&c%s isn't taking new players right now.", b.Name))
+		return
+	case !p.ku.AllowedOn(p.Name(), b):
+		p.Message(fmt.Sprintf("&cYou aren't whitelisted on %s.", b.Name))
+		return
+	case !p.ku.Players.Reserve(p, b):
+		p.Message(fmt.Sprintf("&c%s is full.", b.Name))
+		return
+	}
+
+	// They're no longer in the lobby as far as anything else is concerned,
+	// so they can't be sent anywhere else in the meantime.
+	state := p.State()
+	p.SetState(Identification)
+	queued := p.ku.Queue.Remove(p)
+	go func() {
+		if err := p.Join(b); err != nil {
+			p.Log().Debugf("Unable to send %s to %s: %s", p.Name(), b.Name, err)
+			p.Message(fmt.Sprintf("&cUnable to reach %s, try again later.", b.Name))
+			p.SetState(state)
+			if queued {
+				p.ku.Queue.Add(p)
+			}
+		}
+	}()
+}
+
+// fallBack catches a player whose server has gone away, and holds them in the
+// lobby until it (or another server) is back, rather than disconnecting them.
+// It returns false if the lobby is disabled, or the player was leaving anyway.
+func (p *Player) fallBack(parser *Parser) bool {
+	if !p.ku.Config().Lobby.Enabled || p.State() != Idle || p.kicked {
+		return false
+	}
+	p.qMutex.Lock()
+	quitting := p.quit || p.quitting
+	p.qMutex.Unlock()
+	if quitting {
+		return false
+	}
+
+	p.sMutex.Lock()
+	if p.Server.Parser != parser {
+		p.sMutex.Unlock()
+		return false
+	}
+	conn, b := p.Server.Conn, p.backend
+	p.Server.Conn, p.Server.Parser, p.backend = nil, nil, nil
+	p.sMutex.Unlock()
+
+	parser.Finish()
+	conn.Close()
+	p.ku.Players.SetBackend(p, nil)
+	p.countOn(nil)
+	p.Log().Event("fell_back").Infof("%s (%s) lost their connection to %s", p.Name(), p.Remote(), b.Name)
+
+	p.despawnAll()
+	state, status := Queued, fmt.Sprintf("&cLost connection to %s.", b.Name)
+	if p.ku.Config().Lobby.Hub {
+		state = Limbo
+	}
+	if err := p.hold(state, status); err != nil {
+		p.Log().Warnf("Unable to send the lobby: %s", err)
+		return false
+	}
+	return true
+}
+
+// UsePortal is a client hook which sends players in the lobby to a server when
+// they walk onto its portal.
+func UsePortal(p *Player, dir packets.PacketDirection, packet packets.Packet) bool {
+	if packet.Id() != 0x08 || !p.InLobby() {
+		return false
+	}
+	// PositionOrientation: id, player id, x, y, z, yaw, pitch
+	data := packet.Bytes()
+	if len(data) < 10 {
+		return false
+	}
+	x := int16(binary.BigEndian.Uint16(data[2:]))
+	y := int16(binary.BigEndian.Uint16(data[4:]))
+	z := int16(binary.BigEndian.Uint16(data[6:]))
+
+	b := p.ku.Lobby().Portal(x, y, z)
+	if b == p.portal {
+		// They're still on the same pad (or none at all).
+		return false
+	}
+	p.portal = b
+	if b != nil {
+		p.Travel(b)
+	}
+	return false
+}
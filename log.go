@@ -1,9 +1,17 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/mgutz/ansi"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
 	"log"
+	"os"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -15,9 +23,10 @@ var (
 )
 
 var (
-	colorRegexp = regexp.MustCompile(`&([a-fA-F0-9r])`)
+	// colorRegexp matches anything that looks like a color code. Whether it is
+	// one is up to colorCode, since CPE TextColors lets servers define their own.
+	colorRegexp = regexp.MustCompile(`&(.)`)
 	colors      = map[byte]string{
-		// TODO: the rest of the color codes.
 		'0': ansi.ColorCode("black"),
 		'1': ansi.ColorCode("blue"),
 		'2': ansi.ColorCode("green"),
@@ -37,51 +46,492 @@ var (
 		// Below are not part of official spec.
 		'r': resetColor,
 	}
+
+	// customColors holds the ANSI codes for CPE TextColors codes, as defined
+	// by SetTextColor packets from the servers.
+	customColors = map[byte]string{}
+	ccMutex      sync.RWMutex
 )
 
-// Colorify takes a Minecraft classic chat color-coded string /&[a-f0-9]/, and
-// returns a "colorified" string with ANSI escape codes.
-func Colorify(in string) string {
-	repl := colorRegexp.ReplaceAllFunc([]byte(in), func(s []byte) []byte {
-		if len(s) != 2 {
-			return s
+// SetCustomColor defines a CPE TextColors code, rendered as the closest 24-bit
+// ANSI color. Codes which shadow a Classic code (or '&', or '%') are ignored.
+func SetCustomColor(code, r, g, b byte) {
+	if _, ok := colors[lower(code)]; ok || code == '&' || code == '%' || code <= ' ' || code > '~' {
+		return
+	}
+	ccMutex.Lock()
+	defer ccMutex.Unlock()
+	customColors[code] = fmt.Sprintf("\x1b[38;2;%d;%d;%dm", r, g, b)
+}
+
+// lower lowercases an ASCII letter. The Classic client only understands
+// lowercase codes, but we're more forgiving in logs.
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+// colorCode returns the ANSI code for a Classic (or CPE TextColors) color code,
+// and whether it's a color code at all.
+func colorCode(c byte) (string, bool) {
+	if code, ok := colors[lower(c)]; ok {
+		return code, true
+	}
+	ccMutex.RLock()
+	defer ccMutex.RUnlock()
+	code, ok := customColors[c]
+	return code, ok
+}
+
+// StripColors removes every Classic and CPE color code from a string, for log
+// files and JSON output.
+func StripColors(in string) string {
+	return colorRegexp.ReplaceAllStringFunc(in, func(s string) string {
+		if _, ok := colorCode(s[1]); ok {
+			return ""
 		}
-		b := []byte(colors[s[1]])
-		return b
+		return s
 	})
-	return string(repl) + resetColor
 }
 
+// SanitizeColors makes a chat message safe to send to a client. Old clients
+// crash on a '&' that isn't followed by a valid code (including one at the very
+// end of a message), so those are dropped (leaving whatever followed them), as
+// are any trailing color codes.
+// Uppercase codes are lowercased, "&r" becomes the default "&f", and CPE custom
+// codes are only kept if cpe is true.
+func SanitizeColors(in string, cpe bool) string {
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); i++ {
+		if in[i] != '&' {
+			out = append(out, in[i])
+			continue
+		}
+		if i+1 >= len(in) {
+			break
+		}
+		c := lower(in[i+1])
+		if c == 'r' {
+			c = 'f'
+		}
+		_, classic := colors[c]
+		ccMutex.RLock()
+		_, custom := customColors[in[i+1]]
+		ccMutex.RUnlock()
+		switch {
+		case classic:
+			out = append(out, '&', c)
+			i++
+		case custom:
+			// Dropped for clients which don't support TextColors.
+			if cpe {
+				out = append(out, '&', in[i+1])
+			}
+			i++
+		}
+		// Anything else is a stray '&', which is dropped on its own.
+	}
+	// Trailing color codes do nothing, and crash some clients.
+	for len(out) >= 2 && out[len(out)-2] == '&' {
+		out = out[:len(out)-2]
+	}
+	return string(out)
+}
+
+// Log formats, for a Sink's Format.
+const (
+	LogText = "text" // Human readable, colored if we're writing to a terminal.
+	LogJSON = "json" // One JSON object per line.
+)
+
+// Log channels. Everything is logged to the main channel, except chat (which
+// only goes to chat sinks). Audit entries go to both main and audit sinks.
+const (
+	ChannelMain  = "main"
+	ChannelChat  = "chat"
+	ChannelAudit = "audit"
+)
+
+// Log levels, compared against a Sink's Verbosity.
+const (
+	levelLog   = 0 // Always logged, like warnings.
+	levelInfo  = 1
+	levelDebug = 2
+)
+
+// A Sink is somewhere log entries are written to, such as stderr or a log file.
+// Each sink has its own verbosity and format.
+type Sink struct {
+	Channel   string
+	Verbosity int
+	Format    string
+	Colors    bool // Render color codes as ANSI.
+	RawColors bool // Leave color codes as they are, rather than stripping them.
+
+	logger *log.Logger
+	w      io.Writer
+}
+
+// accepts returns whether the sink wants an entry on the given channel.
+func (s *Sink) accepts(channel string) bool {
+	if s.Channel == channel {
+		return true
+	}
+	return s.Channel == ChannelMain && channel == ChannelAudit
+}
+
+// Close closes the underlying writer, if it can be closed (stderr isn't).
+func (s *Sink) Close() error {
+	if c, ok := s.w.(io.Closer); ok && s.w != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+// NewSink returns a sink writing to w.
+func NewSink(w io.Writer, channel string, verbosity int, format string, colors bool) (*Sink, error) {
+	flags := log.LstdFlags
+	switch format {
+	case LogText, "":
+		format = LogText
+	case LogJSON:
+		flags = 0 // We write our own timestamp.
+		colors = false
+	default:
+		return nil, fmt.Errorf("%q is not a valid log format", format)
+	}
+	return &Sink{
+		Channel:   channel,
+		Verbosity: verbosity,
+		Format:    format,
+		Colors:    colors,
+		logger:    log.New(w, "", flags),
+		w:         w,
+	}, nil
+}
+
+// NewFileSink returns a sink writing to a log file, which is rotated when it
+// reaches c.MaxSize megabytes, and every c.Rotate (if set).
+func NewFileSink(channel string, c LogConfig) (*Sink, error) {
+	w := &lumberjack.Logger{
+		Filename:   c.File,
+		MaxSize:    c.MaxSize,
+		MaxAge:     c.MaxAge,
+		MaxBackups: c.MaxBackups,
+		Compress:   c.Compress,
+	}
+	s, err := NewSink(w, channel, c.Verbosity, c.Format, false)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Colors {
+	case "strip", "":
+	case "raw":
+		s.RawColors = true
+	default:
+		return nil, fmt.Errorf("%q is not a valid color mode (strip or raw)", c.Colors)
+	}
+	if c.Rotate > 0 {
+		go func() {
+			for range time.Tick(time.Duration(c.Rotate)) {
+				if err := w.Rotate(); err != nil {
+					Warnf("Unable to rotate %s: %s", c.File, err)
+				}
+			}
+		}()
+	}
+	return s, nil
+}
+
+var (
+	// stderr is the default sink, whose verbosity is set with -v.
+	stderr, _ = NewSink(os.Stderr, ChannelMain, 0, LogText, isTerminal(os.Stderr))
+	sinks     = []*Sink{stderr}
+	sMut      sync.RWMutex
+
+	// useColors is whether Colorify renders ANSI colors (which it does if
+	// stderr is colored).
+	useColors = stderr.Colors
+)
+
+// isTerminal returns whether f looks like a terminal (a character device),
+// rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// SetLogFormat switches stderr between the colored human format (LogText, the
+// default) and JSON lines (LogJSON). JSON output is never colored.
+func SetLogFormat(format string) error {
+	s, err := NewSink(os.Stderr, ChannelMain, stderr.Verbosity, format, isTerminal(os.Stderr))
+	if err != nil {
+		return err
+	}
+	sMut.Lock()
+	defer sMut.Unlock()
+	*stderr = *s
+	useColors = s.Colors
+	return nil
+}
+
+// SetVerbosity sets the verbosity of stderr.
+func SetVerbosity(v int) {
+	sMut.Lock()
+	defer sMut.Unlock()
+	stderr.Verbosity = v
+}
+
+// SetupLogs adds a file sink for each configured log, alongside stderr.
+func SetupLogs(c LogsConfig) error {
+	for channel, lc := range map[string]*LogConfig{
+		ChannelMain:  c.Main,
+		ChannelChat:  c.Chat,
+		ChannelAudit: c.Audit,
+	} {
+		if lc == nil || lc.File == "" {
+			continue
+		}
+		s, err := NewFileSink(channel, *lc)
+		if err != nil {
+			return err
+		}
+		AddSink(s)
+	}
+	return nil
+}
+
+// AddSink adds another sink for log entries to be written to.
+func AddSink(s *Sink) {
+	sMut.Lock()
+	defer sMut.Unlock()
+	sinks = append(sinks, s)
+}
+
+// HasSink returns whether any sink wants entries on the given channel.
+func HasSink(channel string) bool {
+	sMut.RLock()
+	defer sMut.RUnlock()
+	for _, s := range sinks {
+		if s.Channel == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// CloseSinks closes every sink's writer.
+func CloseSinks() {
+	sMut.Lock()
+	defer sMut.Unlock()
+	for _, s := range sinks {
+		s.Close()
+	}
+}
+
+// wants returns whether any sink would write an entry at this level on this
+// channel, so we can skip formatting entries no one will see.
+func wants(channel string, level int) bool {
+	sMut.RLock()
+	defer sMut.RUnlock()
+	for _, s := range sinks {
+		if s.accepts(channel) && s.Verbosity >= level {
+			return true
+		}
+	}
+	return false
+}
+
+// color returns the given ANSI code, or nothing if colors are turned off.
+func color(c string, enabled bool) string {
+	if !enabled {
+		return ""
+	}
+	return c
+}
+
+// renderColors turns Classic color codes into ANSI codes, or strips them.
+func renderColors(in string, enabled bool) string {
+	if !enabled {
+		return StripColors(in)
+	}
+	repl := colorRegexp.ReplaceAllStringFunc(in, func(s string) string {
+		if code, ok := colorCode(s[1]); ok {
+			return code
+		}
+		return s
+	})
+	return repl + resetColor
+}
+
+// Colorify takes a Minecraft classic chat color-coded string /&[a-f0-9]/ (or
+// one with CPE TextColors codes), and returns a "colorified" string with ANSI
+// escape codes. If colors are turned off, the color codes are just stripped.
+func Colorify(in string) string {
+	return renderColors(in, useColors)
+}
+
+// renderFor renders a message's color codes the way a sink wants them.
+func renderFor(sink *Sink, msg string) string {
+	if sink.RawColors {
+		return msg
+	}
+	return renderColors(msg, sink.Colors && sink.Format != LogJSON)
+}
+
+// Fields is structured context attached to a log line. In the text format only
+// the player id is shown (as the usual "(id) " prefix), but every field is
+// written out in the JSON format.
+type Fields map[string]interface{}
+
+// An Entry is a log line waiting to happen, with some context attached.
+type Entry struct {
+	fields  Fields
+	event   string
+	channel string
+}
+
+// WithFields returns an Entry which logs with the given fields.
+func WithFields(f Fields) *Entry {
+	return &Entry{fields: f}
+}
+
+// Event returns a copy of the entry tagged with an event name (e.g. "connect",
+// "kick"), for easy filtering of JSON logs.
+func (e *Entry) Event(name string) *Entry {
+	return &Entry{fields: e.fields, event: name, channel: e.channel}
+}
+
+// Chat returns a copy of the entry which only goes to chat logs.
+func (e *Entry) Chat() *Entry {
+	return &Entry{fields: e.fields, event: e.event, channel: ChannelChat}
+}
+
+// Audit returns a copy of the entry which goes to audit logs, as well as the
+// main log.
+func (e *Entry) Audit() *Entry {
+	return &Entry{fields: e.fields, event: e.event, channel: ChannelAudit}
+}
+
+func (e *Entry) output(level int, name, c string, codes bool, s string, v ...interface{}) {
+	channel := e.channel
+	if channel == "" {
+		channel = ChannelMain
+	}
+	if !wants(channel, level) {
+		return
+	}
+	msg := fmt.Sprintf(s, v...)
+
+	sMut.RLock()
+	defer sMut.RUnlock()
+	for _, sink := range sinks {
+		if !sink.accepts(channel) || sink.Verbosity < level {
+			continue
+		}
+		if sink.Format == LogJSON {
+			e.writeJSON(sink, name, renderFor(sink, msg))
+		} else if codes {
+			e.writeText(sink, c, renderFor(sink, msg))
+		} else {
+			e.writeText(sink, c, msg)
+		}
+	}
+}
+
+func (e *Entry) writeJSON(sink *Sink, level, msg string) {
+	line := map[string]interface{}{}
+	for k, v := range e.fields {
+		line[k] = v
+	}
+	line["level"] = level
+	line["timestamp"] = time.Now().Format(time.RFC3339Nano)
+	line["msg"] = msg
+	if e.event != "" {
+		line["event"] = e.event
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"level": "error", "msg": err.Error()})
+	}
+	sink.logger.Print(string(b))
+}
+
+func (e *Entry) writeText(sink *Sink, c, msg string) {
+	if id, ok := e.fields["player_id"]; ok {
+		msg = fmt.Sprintf("(%s) %s", id, msg)
+	}
+	if c == "" {
+		sink.logger.Print(msg)
+		return
+	}
+	sink.logger.Print(color(c, sink.Colors) + msg + color(resetColor, sink.Colors))
+}
+
+func (e *Entry) Fatalf(s string, v ...interface{}) {
+	e.output(levelLog, "fatal", fatalColor, false, s, v...)
+	CloseSinks()
+	os.Exit(1)
+}
+
+func (e *Entry) Warnf(s string, v ...interface{}) {
+	e.output(levelLog, "warn", warnColor, false, s, v...)
+}
+
+func (e *Entry) Debugf(s string, v ...interface{}) {
+	e.output(levelDebug, "debug", debugColor, false, s, v...)
+}
+
+func (e *Entry) Infof(s string, v ...interface{}) {
+	e.output(levelInfo, "info", infoColor, false, s, v...)
+}
+
+func (e *Entry) Logf(s string, v ...interface{}) {
+	e.output(levelLog, "log", "", false, s, v...)
+}
+
+// Colorf logs a message containing Classic color codes, which are rendered as
+// ANSI colors on colored sinks, and stripped everywhere else.
+func (e *Entry) Colorf(s string, v ...interface{}) {
+	e.output(levelLog, "log", "", true, s, v...)
+}
+
+// std is the Entry used by the package level functions, with no context.
+var std = &Entry{}
+
 func Fatalf(s string, v ...interface{}) {
-	log.Fatalf(fatalColor+s+resetColor, v...)
+	std.Fatalf(s, v...)
 }
 
 func Fatal(v ...interface{}) {
-	log.Fatal(v...)
+	std.Fatalf("%s", fmt.Sprint(v...))
 }
 
 func Warnf(s string, v ...interface{}) {
-	log.Printf(warnColor+s+resetColor, v...)
+	std.Warnf(s, v...)
 }
 
 func Debugf(s string, v ...interface{}) {
-	if verbosity < 2 {
-		return
-	}
-	log.Printf(debugColor+s+resetColor, v...)
+	std.Debugf(s, v...)
 }
 
 func Infof(s string, v ...interface{}) {
-	if verbosity < 1 {
-		return
-	}
-	log.Printf(infoColor+s+resetColor, v...)
+	std.Infof(s, v...)
 }
 
 func Logf(s string, v ...interface{}) {
-	log.Printf(s, v...)
+	std.Logf(s, v...)
+}
+
+func Colorf(s string, v ...interface{}) {
+	std.Colorf(s, v...)
 }
 
 func Log(s ...interface{}) {
-	log.Println(s...)
+	std.Logf("%s", strings.TrimSuffix(fmt.Sprintln(s...), "\n"))
 }
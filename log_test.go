@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestSanitizeColors(t *testing.T) {
+	SetCustomColor('x', 0xff, 0x80, 0x00)
+	defer func() {
+		ccMutex.Lock()
+		delete(customColors, 'x')
+		ccMutex.Unlock()
+	}()
+
+	tests := []struct {
+		in       string
+		cpe      bool
+		expected string
+	}{
+		{"&aHello", false, "&aHello"},
+		{"&AHello", false, "&aHello"},
+		{"&rHello", false, "&fHello"},
+		{"&a&bHello", false, "&a&bHello"},
+		{"AT&T", false, "ATT"},
+		{"fish & chips", false, "fish  chips"},
+		{"a&&eb", false, "a&eb"},
+		{"&", false, ""},
+		{"Hello&", false, "Hello"},
+		{"Hello&a", false, "Hello"},
+		{"Hello&a&b", false, "Hello"},
+		{"Hello&a&", false, "Hello"},
+		{"&xHello", true, "&xHello"},
+		{"&xHello", false, "Hello"},
+		{"&XHello", true, "XHello"},
+		{"Hello&x", true, "Hello"},
+		{"&x&cHello", false, "&cHello"},
+	}
+	for _, test := range tests {
+		if out := SanitizeColors(test.in, test.cpe); out != test.expected {
+			t.Errorf("SanitizeColors(%q, %v) = %q, want %q", test.in, test.cpe, out, test.expected)
+		}
+	}
+}
+
+func TestStripColors(t *testing.T) {
+	SetCustomColor('x', 0xff, 0x80, 0x00)
+	defer func() {
+		ccMutex.Lock()
+		delete(customColors, 'x')
+		ccMutex.Unlock()
+	}()
+
+	tests := []struct {
+		in, expected string
+	}{
+		{"&aHello &fworld", "Hello world"},
+		{"&AHello&R", "Hello"},
+		{"&xCustom", "Custom"},
+		{"AT&T", "AT&T"},
+		{"fish & chips", "fish & chips"},
+		{"trailing&", "trailing&"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if out := StripColors(test.in); out != test.expected {
+			t.Errorf("StripColors(%q) = %q, want %q", test.in, out, test.expected)
+		}
+	}
+}
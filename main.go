@@ -7,49 +7,88 @@ import (
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 )
 
 var (
-	Ku        *Kurafuto
-	verbosity int
+	Ku *Kurafuto
 )
 
+// sigintQuit drains Kurafuto on the first signal, and quits straight away on the
+// second.
 func sigintQuit(c <-chan os.Signal) {
 	<-c
 	if Ku == nil {
 		return
 	}
-	log.Println("Shutting down!")
+	log.Println("Shutting down! (Again to quit now)")
+	go Ku.Drain(time.Duration(Ku.Config().Drain.Deadline))
+	<-c
+	log.Println("Quitting now!")
 	Ku.Quit()
 }
 
+// sigusr2Upgrade upgrades Kurafuto (to whatever binary is now at its path).
+func sigusr2Upgrade(c <-chan os.Signal) {
+	for {
+		<-c
+		if Ku == nil {
+			return
+		}
+		log.Println("Upgrading!")
+		if err := Ku.Upgrade(); err != nil {
+			Warnf("Unable to upgrade: %s", err)
+		}
+	}
+}
+
 func sighupReload(c <-chan os.Signal) {
 	for {
 		<-c
 		if Ku == nil {
 			return
 		}
-		log.Println("Should reload config now, but that isn't implemented.")
+		log.Println("Reloading config!")
+		if err := Ku.Reload(); err != nil {
+			Warnf("Unable to reload config: %s", err)
+		}
 	}
 }
 
 ////////////////////
-//Detect number of CPU cores to use
+
+// Detect number of CPU cores to use
 var cpus = runtime.NumCPU()
 
 func main() {
 	//Enable Multiple core usage
 	runtime.GOMAXPROCS(cpus)
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
+
 	configFile := flag.String("config", "kurafuto.json", "the file your Kurafuto configuration is stored in.")
 	//forceSalt := flag.String("forceSalt", "", "force a specific salt to be used (don't do this!)")
-	flag.IntVar(&verbosity, "v", 0, "Debugging verbosity level.")
+	verbosity := flag.Int("v", 0, "Debugging verbosity level (of stderr).")
+	console := flag.Bool("console", false, "read admin commands from stdin.")
+	logFormat := flag.String("log-format", LogText, "log format: text (colored, if on a terminal) or json.")
 	flag.Parse()
 
+	if err := SetLogFormat(*logFormat); err != nil {
+		log.Fatal(err)
+	}
+	SetVerbosity(*verbosity)
+
 	config, err := NewConfigFile(*configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if err := SetupLogs(config.Logs); err != nil {
+		log.Fatal(err)
+	}
+	defer CloseSinks()
+
 	ku, err := NewKurafuto(config)
 	if err != nil {
 		log.Fatal(err)
@@ -59,10 +98,12 @@ func main() {
 		ku.salt = *forceSalt
 	}*/
 
+	ku.ConfigFile = *configFile
 	Ku = ku // Make it global.
 
 	Infof("Kurafuto now listening on %s:%d with %d servers", config.Address, config.Port, len(config.Servers))
-	Debugf("Debugging level %d enabled! (Salt: %s)", verbosity, Ku.salt)
+	config.warnUnverified()
+	Debugf("Debugging level %d enabled! (Salt: %s)", *verbosity, Ku.salt)
 	if len(config.Ignore) > 0 {
 		Debugf("Ignoring these packets: %s", config.Ignore.String())
 	}
@@ -72,8 +113,38 @@ func main() {
 	if len(config.DropExts) > 0 {
 		Debugf("Dropping these extensions: %s", config.DropExts)
 	}
+	for _, cp := range config.CustomPackets {
+		Debugf("Forwarding custom packet %#.2x (%s, %d bytes)", byte(cp.Id), cp.Name, cp.Size)
+	}
+
+	if config.Metrics != "" {
+		go func() {
+			Infof("Serving metrics on http://%s/metrics", config.Metrics)
+			if err := ServeMetrics(config.Metrics); err != nil {
+				Warnf("Metrics listener stopped: %s", err)
+			}
+		}()
+	}
+
+	if config.Admin.Enabled {
+		go func() {
+			Infof("Serving admin API on http://%s/", config.Admin.Address)
+			if err := ServeAdmin(ku, config.Admin.Address, config.Admin.Token); err != nil {
+				Warnf("Admin API listener stopped: %s", err)
+			}
+		}()
+	}
 
-	sigint := make(chan os.Signal, 1)
+	if ku.Mesh != nil {
+		go func() {
+			Infof("Meshing as %s on %s with %d peers", config.Mesh.Node, config.Mesh.Address, len(config.Mesh.Peers))
+			if err := ServeMesh(ku.Mesh, config.Mesh.Address); err != nil {
+				Warnf("Mesh listener stopped: %s", err)
+			}
+		}()
+	}
+
+	sigint := make(chan os.Signal, 2)
 	signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 	go sigintQuit(sigint)
 
@@ -81,6 +152,14 @@ func main() {
 	signal.Notify(sighup, syscall.SIGHUP)
 	go sighupReload(sighup)
 
+	sigusr2 := make(chan os.Signal, 1)
+	notifyUpgrade(sigusr2)
+	go sigusr2Upgrade(sigusr2)
+
 	go ku.Run()
+	signalReady()
+	if *console {
+		go NewConsole(ku, os.Stdin).Run()
+	}
 	<-ku.Done
 }
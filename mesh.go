@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mesh event types.
+const (
+	MeshBan     = "ban"   // Ban is added to the ban list.
+	MeshUnban   = "unban" // The ban on Target is removed.
+	MeshKick    = "kick"  // The player called Target is kicked, with Reason.
+	MeshChat    = "chat"  // Message is broadcast to every player (but those ignoring By).
+	MeshMessage = "msg"   // Message is sent privately from By to Target.
+)
+
+// MeshPlayer is a player logged in to a peer.
+type MeshPlayer struct {
+	Name   string `json:"name"`
+	Server string `json:"server"`
+}
+
+// MeshBackend is a peer's view of a backend's health.
+type MeshBackend struct {
+	Name    string    `json:"name"`
+	Healthy bool      `json:"healthy"`
+	Checked time.Time `json:"checked"`
+}
+
+// MeshState is what Kurafuto instances tell each other about themselves, every
+// mesh interval.
+type MeshState struct {
+	Node     string        `json:"node"`
+	Players  []MeshPlayer  `json:"players"`
+	Backends []MeshBackend `json:"backends"`
+
+	heard time.Time // When we received it, by our own clock.
+}
+
+// A MeshEvent is a change which is passed on to every peer once, rather than
+// being part of each instance's state.
+type MeshEvent struct {
+	Type    string `json:"type"`
+	Node    string `json:"node"` // Where it came from.
+	Ban     *Ban   `json:"ban,omitempty"`
+	Target  string `json:"target,omitempty"`
+	By      string `json:"by,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Mesh links this Kurafuto to other instances (its peers), so that between them
+// they know who's logged in where, which backends are up, and who's banned.
+// Every instance pushes its state to each of its peers every interval (and gets
+// theirs back in return), so the mesh expects every instance to list every
+// other one as a peer. A nil *Mesh is a mesh with no peers.
+type Mesh struct {
+	ku     *Kurafuto
+	client *http.Client
+
+	states map[string]*MeshState   // Node -> what it last told us.
+	outbox map[string][]*MeshEvent // Peer address -> events not delivered yet.
+	wake   chan struct{}
+	mutex  sync.Mutex
+}
+
+// Node returns this instance's name in the mesh.
+func (m *Mesh) Node() string {
+	return m.ku.Config().Mesh.Node
+}
+
+// State returns this instance's current state, to send to peers.
+func (m *Mesh) State() *MeshState {
+	s := &MeshState{Node: m.Node(), Players: []MeshPlayer{}, Backends: []MeshBackend{}}
+	for _, p := range m.ku.Players.Snapshot() {
+		b := p.Backend()
+		if p.State() != Idle || b == nil {
+			continue
+		}
+		s.Players = append(s.Players, MeshPlayer{p.Name(), string(b.Name)})
+	}
+	for _, b := range m.ku.Backends() {
+		s.Backends = append(s.Backends, MeshBackend{string(b.Name), b.Healthy(), b.Checked()})
+	}
+	return s
+}
+
+// States returns the latest state from each peer that's been heard from
+// recently, ordered by node name.
+func (m *Mesh) States() []*MeshState {
+	if m == nil {
+		return nil
+	}
+	expiry := 3 * time.Duration(m.ku.Config().Mesh.Interval)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	states := []*MeshState{}
+	for node, s := range m.states {
+		if time.Since(s.heard) > expiry {
+			delete(m.states, node)
+			continue
+		}
+		i := len(states)
+		for i > 0 && states[i-1].Node > node {
+			i--
+		}
+		states = append(states, nil)
+		copy(states[i+1:], states[i:])
+		states[i] = s
+	}
+	return states
+}
+
+// Where returns the node a player is logged in to elsewhere in the mesh, or "".
+func (m *Mesh) Where(name string) string {
+	for _, s := range m.States() {
+		for _, mp := range s.Players {
+			if strings.EqualFold(mp.Name, name) {
+				return s.Node
+			}
+		}
+	}
+	return ""
+}
+
+// Online returns how many players are logged in to peers.
+func (m *Mesh) Online() int {
+	n := 0
+	for _, s := range m.States() {
+		n += len(s.Players)
+	}
+	return n
+}
+
+// Count returns how many players are on the named backend through peers.
+func (m *Mesh) Count(server string) int {
+	n := 0
+	for _, s := range m.States() {
+		for _, mp := range s.Players {
+			if strings.EqualFold(mp.Server, server) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Publish queues an event to be passed on to every peer, and sends it as soon
+// as possible. Events are retried until each peer takes them, so a peer which
+// is down catches up once it's back (as long as this instance is still up).
+func (m *Mesh) Publish(e *MeshEvent) {
+	if m == nil {
+		return
+	}
+	e.Node = m.Node()
+	m.mutex.Lock()
+	for _, addr := range m.ku.Config().Mesh.Peers {
+		m.outbox[addr] = append(m.outbox[addr], e)
+	}
+	m.mutex.Unlock()
+	m.poke()
+}
+
+// poke wakes run, to sync with peers early.
+func (m *Mesh) poke() {
+	if m == nil {
+		return
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// hear takes in a peer's state, and any newer health checks it's made.
+func (m *Mesh) hear(s *MeshState) {
+	if s.Node == "" || s.Node == m.Node() {
+		return
+	}
+	s.heard = time.Now()
+	m.mutex.Lock()
+	m.states[s.Node] = s
+	m.mutex.Unlock()
+
+	for _, mb := range s.Backends {
+		if b := m.ku.Backend(mb.Name); b != nil {
+			b.hearHealth(mb.Healthy, mb.Checked, s.Node)
+		}
+	}
+}
+
+// apply carries out an event from a peer.
+func (m *Mesh) apply(e *MeshEvent) {
+	log := WithFields(Fields{"node": e.Node})
+	switch e.Type {
+	case MeshBan:
+		if e.Ban == nil || m.ku.Bans == nil {
+			return
+		}
+		if err := m.ku.addBan(e.Ban); err != nil {
+			log.Warnf("Unable to add ban from %s: %s", e.Node, err)
+			return
+		}
+		log.Audit().Event("ban").Infof("%s banned %s (via %s)", e.Ban.By, e.Ban, e.Node)
+	case MeshUnban:
+		if m.ku.Bans == nil {
+			return
+		}
+		if ok, err := m.ku.Bans.Remove(e.Target); err != nil {
+			log.Warnf("Unable to remove ban from %s: %s", e.Node, err)
+		} else if ok {
+			log.Audit().Event("unban").Infof("%s unbanned %s (via %s)", e.By, e.Target, e.Node)
+		}
+	case MeshKick:
+		if p := m.ku.Players.Name(e.Target); p != nil {
+			p.Log().Event("mesh_kick").Infof("%s kicked by %s: %s", p.Name(), e.Node, e.Reason)
+			p.Kick(e.Reason)
+		}
+	case MeshChat:
+		m.ku.broadcast(e.Message, e.By)
+	case MeshMessage:
+		if err := m.ku.deliver(e.By, e.Target, e.Message); err != nil {
+			log.Debugf("Unable to deliver message from %s to %s: %s", e.By, e.Target, err)
+		}
+	default:
+		log.Debugf("Unknown mesh event %q from %s", e.Type, e.Node)
+	}
+}
+
+// post sends a JSON body to a peer, and decodes its JSON reply into v (if v
+// isn't nil).
+func (m *Mesh) post(addr, path string, body, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", "http://"+addr+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.ku.Config().Mesh.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kurafuto: Peer returned %s", resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// sync swaps states with a peer, and delivers any events waiting for it. If the
+// peer can't be reached, kicks and chat (including private messages) are dropped
+// rather than retried: by the time it's back, they'd be out of date.
+func (m *Mesh) sync(addr string, state *MeshState) error {
+	var theirs MeshState
+	err := m.post(addr, "/state", state, &theirs)
+	if err == nil {
+		m.hear(&theirs)
+	}
+
+	m.mutex.Lock()
+	events := m.outbox[addr]
+	m.mutex.Unlock()
+	if len(events) > 0 && err == nil {
+		err = m.post(addr, "/events", events, nil)
+	}
+	if err != nil {
+		m.mutex.Lock()
+		kept := []*MeshEvent{}
+		for _, e := range m.outbox[addr] {
+			if e.Type != MeshKick && e.Type != MeshChat && e.Type != MeshMessage {
+				kept = append(kept, e)
+			}
+		}
+		m.outbox[addr] = kept
+		m.mutex.Unlock()
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	m.mutex.Lock()
+	m.outbox[addr] = m.outbox[addr][len(events):]
+	m.mutex.Unlock()
+	return nil
+}
+
+// run syncs with every peer each interval (or sooner, when there's something
+// to tell them), until Kurafuto stops running.
+func (m *Mesh) run() {
+	tick := time.NewTicker(time.Duration(m.ku.Config().Mesh.Interval))
+	defer tick.Stop()
+
+	failing := map[string]bool{}
+	for {
+		ku := m.ku
+		ku.rMut.Lock()
+		running := ku.Running
+		ku.rMut.Unlock()
+		if !running {
+			return
+		}
+
+		state := m.State()
+		for _, addr := range ku.Config().Mesh.Peers {
+			err := m.sync(addr, state)
+			if err != nil && !failing[addr] {
+				Warnf("Unable to reach mesh peer %s: %s", addr, err)
+			} else if err == nil && failing[addr] {
+				Infof("Mesh peer %s is back", addr)
+			}
+			failing[addr] = err != nil
+		}
+
+		select {
+		case <-m.wake:
+		case <-tick.C:
+		}
+	}
+}
+
+func (m *Mesh) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+m.ku.Config().Mesh.Token)) != 1 {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/state":
+		var s MeshState
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.hear(&s)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.State())
+	case "/events":
+		var events []*MeshEvent
+		if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, e := range events {
+			m.apply(e)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func NewMesh(ku *Kurafuto) *Mesh {
+	return &Mesh{
+		ku:     ku,
+		client: &http.Client{Timeout: 5 * time.Second},
+		states: map[string]*MeshState{},
+		outbox: map[string][]*MeshEvent{},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// ServeMesh serves the mesh's peer protocol on addr. It blocks, like
+// http.ListenAndServe, so it should be run in its own goroutine.
+func ServeMesh(m *Mesh, addr string) error {
+	l, err := listen("mesh", addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, m)
+}
+
+// meshNode is the default node name: the machine's hostname, and the port the
+// mesh is served on, which is unique enough for instances sharing a machine.
+func meshNode(addr string) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "kurafuto"
+	}
+	if i := strings.LastIndex(addr, ":"); i >= 0 {
+		return host + addr[i:]
+	}
+	return host
+}
+
+////
+
+// NetworkOnline returns how many players are logged in across the mesh.
+func (ku *Kurafuto) NetworkOnline() int {
+	return ku.Players.Online() + ku.Mesh.Online()
+}
+
+// NetworkCount returns how many players are on a backend across the mesh.
+func (ku *Kurafuto) NetworkCount(b *Backend) int {
+	return ku.Players.Count(b) + ku.Mesh.Count(string(b.Name))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMeshToken = "hunter2"
+
+// meshNodeForTest builds a Kurafuto with a mesh but no listener, serves its
+// peer protocol with httptest, and returns it along with the peer address.
+func meshNodeForTest(t *testing.T, node string) (*Kurafuto, string) {
+	bans, err := LoadBanList(filepath.Join(t.TempDir(), "bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		Servers: []Server{{Name: "Server_A", Address: "127.0.0.1", Port: 25565}},
+		Mesh: MeshConfig{
+			Enabled:  true,
+			Node:     node,
+			Token:    testMeshToken,
+			Interval: duration(time.Minute),
+		},
+	}
+	ku := &Kurafuto{Players: NewRegistry(), config: config, Bans: bans, Ignores: NewIgnoreList()}
+	ku.setBackends(config.Servers)
+	ku.Mesh = NewMesh(ku)
+
+	srv := httptest.NewServer(ku.Mesh)
+	t.Cleanup(srv.Close)
+	return ku, strings.TrimPrefix(srv.URL, "http://")
+}
+
+// meshPair links two nodes, "a" and "b", as each other's peers.
+func meshPair(t *testing.T) (a *Kurafuto, addrA string, b *Kurafuto, addrB string) {
+	a, addrA = meshNodeForTest(t, "a")
+	b, addrB = meshNodeForTest(t, "b")
+	a.config.Mesh.Peers = []string{addrB}
+	b.config.Mesh.Peers = []string{addrA}
+	return
+}
+
+// addIdlePlayer adds a player who's logged in to the node's first backend.
+func addIdlePlayer(t *testing.T, ku *Kurafuto, name string) *Player {
+	c, s := net.Pipe()
+	t.Cleanup(func() { c.Close(); s.Close() })
+	p := &Player{Id: name, name: name, ku: ku, state: Idle, backend: ku.Backends()[0]}
+	p.Client.Conn = c
+	ku.Players.Add(p)
+	ku.Players.Claim(p, false, false)
+	ku.Players.SetBackend(p, p.backend)
+	return p
+}
+
+func TestMeshToken(t *testing.T) {
+	ku, addr := meshNodeForTest(t, "a")
+	body := `{"node": "b", "players": [{"name": "alice", "server": "Server_A"}]}`
+
+	for _, auth := range []string{"", "Bearer wrong", "Bearer " + testMeshToken + "x", testMeshToken} {
+		req, _ := http.NewRequest("POST", "http://"+addr+"/state", strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: got %s, want 401", auth, resp.Status)
+		}
+	}
+	if node := ku.Mesh.Where("alice"); node != "" {
+		t.Errorf("state with a bad token was heard: alice is on %q", node)
+	}
+
+	req, _ := http.NewRequest("POST", "http://"+addr+"/state", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testMeshToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("good token: got %s, want 200", resp.Status)
+	}
+	if node := ku.Mesh.Where("alice"); node != "b" {
+		t.Errorf("Where(alice) = %q, want b", node)
+	}
+}
+
+func TestMeshPlayers(t *testing.T) {
+	a, _, b, addrB := meshPair(t)
+	addIdlePlayer(t, a, "alice")
+	addIdlePlayer(t, b, "bob")
+	addIdlePlayer(t, b, "carol")
+
+	// One sync swaps states both ways.
+	if err := a.Mesh.sync(addrB, a.Mesh.State()); err != nil {
+		t.Fatal(err)
+	}
+	if node := a.Mesh.Where("BOB"); node != "b" {
+		t.Errorf("a: Where(BOB) = %q, want b", node)
+	}
+	if node := b.Mesh.Where("alice"); node != "a" {
+		t.Errorf("b: Where(alice) = %q, want a", node)
+	}
+	if node := a.Mesh.Where("alice"); node != "" {
+		t.Errorf("a: Where(alice) = %q, want \"\" (they're local)", node)
+	}
+	if n := a.NetworkOnline(); n != 3 {
+		t.Errorf("a: NetworkOnline() = %d, want 3", n)
+	}
+	if n := b.NetworkCount(b.Backends()[0]); n != 3 {
+		t.Errorf("b: NetworkCount(Server_A) = %d, want 3", n)
+	}
+}
+
+func TestMeshBans(t *testing.T) {
+	a, _, b, addrB := meshPair(t)
+
+	if _, err := a.Ban("griefer", 0, "griefing", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Mesh.sync(addrB, a.Mesh.State()); err != nil {
+		t.Fatal(err)
+	}
+	if ban := b.Bans.Check("Griefer", nil); ban == nil || ban.Reason != "griefing" {
+		t.Fatalf("b: Check(Griefer) = %v, want the ban from a", ban)
+	}
+
+	if err := a.Unban("griefer", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Mesh.sync(addrB, a.Mesh.State()); err != nil {
+		t.Fatal(err)
+	}
+	if ban := b.Bans.Check("griefer", nil); ban != nil {
+		t.Errorf("b: Check(griefer) = %v after the unban, want nil", ban)
+	}
+}
+
+func TestMeshDownPeer(t *testing.T) {
+	a, _ := meshNodeForTest(t, "a")
+	srv := httptest.NewServer(http.NotFoundHandler())
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	srv.Close()
+	a.config.Mesh.Peers = []string{addr}
+
+	if _, err := a.Ban("griefer", 0, "", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	a.Mesh.Publish(&MeshEvent{Type: MeshKick, Target: "alice"})
+	a.Mesh.Publish(&MeshEvent{Type: MeshChat, Message: "hello"})
+	if err := a.Mesh.sync(addr, a.Mesh.State()); err == nil {
+		t.Fatal("sync with a down peer succeeded")
+	}
+
+	// Bans are kept for when the peer's back; kicks and chat aren't.
+	outbox := a.Mesh.outbox[addr]
+	if len(outbox) != 1 || outbox[0].Type != MeshBan {
+		t.Errorf("outbox after a failed sync = %v, want just the ban", outbox)
+	}
+}
+
+func TestMeshHealth(t *testing.T) {
+	a, _, b, addrB := meshPair(t)
+	a.Backends()[0].setHealthy(true)
+	time.Sleep(time.Millisecond)
+	b.Backends()[0].setHealthy(false)
+
+	// b checked more recently, so a takes its word for it.
+	if err := a.Mesh.sync(addrB, a.Mesh.State()); err != nil {
+		t.Fatal(err)
+	}
+	if a.Backends()[0].Healthy() {
+		t.Error("a: Server_A is healthy, but b saw it go down more recently")
+	}
+
+	// An older check doesn't override a newer one.
+	b.Backends()[0].hearHealth(true, time.Now().Add(-time.Hour), "c")
+	if b.Backends()[0].Healthy() {
+		t.Error("b: an older check from a peer overrode a newer one")
+	}
+}
+
+func TestMeshExpiry(t *testing.T) {
+	a, _, b, addrB := meshPair(t)
+	a.config.Mesh.Interval = duration(10 * time.Millisecond)
+	addIdlePlayer(t, b, "bob")
+
+	if err := a.Mesh.sync(addrB, a.Mesh.State()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(a.Mesh.States()); n != 1 {
+		t.Fatalf("a: %d peer states, want 1", n)
+	}
+	// Peers that haven't been heard from in 3 intervals are forgotten.
+	time.Sleep(50 * time.Millisecond)
+	if node := a.Mesh.Where("bob"); node != "" {
+		t.Errorf("a: Where(bob) = %q after b went quiet, want \"\"", node)
+	}
+}
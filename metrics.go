@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/kurafuto/kyubu/packets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons a connection can be rejected, used as the "reason" label of
+// kurafuto_connections_rejected_total.
+const (
+	RejectAuth         = "auth"
+	RejectIdentTimeout = "ident_timeout"
+	RejectIdent        = "ident_invalid"
+	RejectDial         = "dial"
+	RejectBanned       = "banned"
+	RejectWhitelist    = "whitelist"
+	RejectRateLimit    = "rate_limit"
+	RejectIPLimit      = "ip_limit"
+	RejectFull         = "full"
+	RejectDuplicate    = "duplicate"
+)
+
+var (
+	metricPlayers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kurafuto",
+		Name:      "players",
+		Help:      "Players currently connected, by backend server.",
+	}, []string{"backend"})
+
+	metricQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "kurafuto",
+		Name:      "queued_players",
+		Help:      "Players waiting in the join queue.",
+	})
+
+	metricAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "kurafuto",
+		Name:      "connections_accepted_total",
+		Help:      "Connections accepted by the listener.",
+	})
+
+	metricRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kurafuto",
+		Name:      "connections_rejected_total",
+		Help:      "Connections rejected, by reason.",
+	}, []string{"reason"})
+
+	metricPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kurafuto",
+		Name:      "packets_total",
+		Help:      "Packets parsed, by direction and packet id.",
+	}, []string{"direction", "id"})
+
+	metricBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kurafuto",
+		Name:      "packet_bytes_total",
+		Help:      "Bytes of packets parsed, by direction and packet id.",
+	}, []string{"direction", "id"})
+
+	metricDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kurafuto",
+		Name:      "dropped_packets_total",
+		Help:      "Packets dropped by DropPacket, by the rule (packet id or extension) that matched.",
+	}, []string{"rule"})
+
+	metricLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kurafuto",
+		Name:      "limited_packets_total",
+		Help:      "Packets over a per-player rate limit, by packet id (or \"chat\"/\"duplicate\") and action.",
+	}, []string{"id", "action"})
+
+	metricHooks = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "kurafuto",
+		Name:      "hook_duration_seconds",
+		Help:      "Time taken to run each packet hook.",
+		Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05},
+	}, []string{"hook"})
+
+	metricDial = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "kurafuto",
+		Name:      "backend_dial_duration_seconds",
+		Help:      "Time taken to dial a backend server.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	metricHeartbeats = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kurafuto",
+		Name:      "heartbeats_total",
+		Help:      "Heartbeats sent, by heartbeat service and result.",
+	}, []string{"heartbeat", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricPlayers,
+		metricQueued,
+		metricAccepted,
+		metricRejected,
+		metricPackets,
+		metricBytes,
+		metricDropped,
+		metricLimited,
+		metricHooks,
+		metricDial,
+		metricHeartbeats,
+	)
+}
+
+// directionLabel turns a packet direction into a metric label.
+func directionLabel(dir packets.PacketDirection) string {
+	switch dir {
+	case packets.ServerBound:
+		return "serverbound"
+	case packets.ClientBound:
+		return "clientbound"
+	}
+	return "unknown"
+}
+
+// countPacket records a parsed packet against the packet and byte counters.
+func countPacket(dir packets.PacketDirection, packet packets.Packet) {
+	d, id := directionLabel(dir), fmt.Sprintf("%#.2x", packet.Id())
+	metricPackets.WithLabelValues(d, id).Inc()
+	metricBytes.WithLabelValues(d, id).Add(float64(packet.Size()))
+}
+
+// since returns the seconds elapsed since t, for observing histograms.
+func since(t time.Time) float64 {
+	return time.Since(t).Seconds()
+}
+
+// ServeMetrics serves Prometheus metrics on addr at "/metrics". It blocks, like
+// http.ListenAndServe, so it should be run in its own goroutine.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	l, err := listen("metrics", addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, mux)
+}
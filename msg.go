@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	errOffline = errors.New("kurafuto: Player isn't online")
+	errIgnored = errors.New("kurafuto: Player is ignoring the sender")
+)
+
+// IgnoreList remembers who each player is ignoring, by name, so it carries
+// over when they reconnect (but not when Kurafuto restarts).
+type IgnoreList struct {
+	ignores map[string]map[string]bool // Lowercased name -> lowercased names.
+	mutex   sync.Mutex
+}
+
+// Ignore makes one player ignore another.
+func (l *IgnoreList) Ignore(name, other string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	name = strings.ToLower(name)
+	if l.ignores[name] == nil {
+		l.ignores[name] = map[string]bool{}
+	}
+	l.ignores[name][strings.ToLower(other)] = true
+}
+
+// Unignore stops one player ignoring another. It returns false if they weren't
+// ignoring them.
+func (l *IgnoreList) Unignore(name, other string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	name, other = strings.ToLower(name), strings.ToLower(other)
+	if !l.ignores[name][other] {
+		return false
+	}
+	delete(l.ignores[name], other)
+	if len(l.ignores[name]) == 0 {
+		delete(l.ignores, name)
+	}
+	return true
+}
+
+// Ignoring returns whether one player is ignoring another.
+func (l *IgnoreList) Ignoring(name, other string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.ignores[strings.ToLower(name)][strings.ToLower(other)]
+}
+
+// List returns who a player is ignoring, sorted.
+func (l *IgnoreList) List(name string) []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	names := []string{}
+	for other := range l.ignores[strings.ToLower(name)] {
+		names = append(names, other)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func NewIgnoreList() *IgnoreList {
+	return &IgnoreList{ignores: map[string]map[string]bool{}}
+}
+
+////
+
+// PrivateMessage sends a private message from one player to another, whichever
+// server (or mesh peer) they're on. Messages to players on a peer are sent off
+// without waiting to hear whether they were delivered.
+func (ku *Kurafuto) PrivateMessage(from *Player, to, message string) error {
+	err := ku.deliver(from.Name(), to, message)
+	if err == errOffline && ku.Mesh.Where(to) != "" {
+		ku.Mesh.Publish(&MeshEvent{Type: MeshMessage, By: from.Name(), Target: to, Message: message})
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if p := ku.Players.Name(to); p != nil {
+		to = p.Name()
+	}
+	from.Message(fmt.Sprintf("&d[you -> %s] &f%s", to, message))
+	return nil
+}
+
+// deliver shows a private message to a player connected here.
+func (ku *Kurafuto) deliver(from, to, message string) error {
+	p := ku.Players.Name(to)
+	if p == nil {
+		return errOffline
+	}
+	if s := p.State(); s == Connecting || s == Disconnected {
+		return errOffline
+	}
+	if ku.Ignores.Ignoring(p.Name(), from) {
+		return errIgnored
+	}
+	p.Log().Chat().Event("private_message").Colorf("&d[%s -> %s]&r %s", from, p.Name(), message)
+	p.tMutex.Lock()
+	p.replyTo = from
+	p.tMutex.Unlock()
+	return p.Message(fmt.Sprintf("&d[%s -> you] &f%s", from, message))
+}
+
+// lastSender returns who last sent the player a private message, or "".
+func (p *Player) lastSender() string {
+	p.tMutex.Lock()
+	defer p.tMutex.Unlock()
+	return p.replyTo
+}
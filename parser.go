@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/dchest/uniuri"
 	"github.com/kurafuto/kyubu/packets"
+	"io"
 	"net"
+	"reflect"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
 )
@@ -21,8 +26,9 @@ var (
 type Hook func(*Player, packets.PacketDirection, packets.Packet) bool
 
 type hookInfo struct {
-	Id string
-	F  Hook
+	Id   string
+	Name string // The hook function's name, for metrics.
+	F    Hook
 }
 
 // AllPackets is a special sentinel type that allows registration of hooks run
@@ -41,6 +47,126 @@ func (p AllPackets) Bytes() []byte {
 	return []byte{0xff}
 }
 
+// RawPacket is an opaque packet, used for the "custom-packets" declared in the
+// config. Kurafuto knows nothing about it other than its id and size, so it's
+// forwarded byte-for-byte.
+type RawPacket struct {
+	Data []byte
+}
+
+func (p *RawPacket) Id() byte {
+	return p.Data[0]
+}
+func (p *RawPacket) Size() int {
+	return len(p.Data)
+}
+func (p *RawPacket) Bytes() []byte {
+	return p.Data
+}
+
+// customPackets holds the custom packets registered so far, by id. Kyubu can't
+// unregister a packet, so they stay registered for as long as Kurafuto runs.
+var (
+	customPackets = map[packetId]CustomPacket{}
+	cpMutex       sync.Mutex
+)
+
+// RegisterCustomPackets registers each of the given custom packets with Kyubu,
+// so they're parsed as a RawPacket of a fixed size, rather than causing an
+// "unknown packet" error. Kyubu keys packets by id alone, so a custom packet
+// can't have a different size in each direction. Packets which were already
+// registered are skipped, so it's safe to call again on reload.
+func RegisterCustomPackets(list []CustomPacket) error {
+	cpMutex.Lock()
+	defer cpMutex.Unlock()
+	for _, cp := range list {
+		if old, ok := customPackets[cp.Id]; ok {
+			if old != cp {
+				Warnf("Custom packet %#.2x changed, this needs a restart", byte(cp.Id))
+			}
+			continue
+		}
+		size := cp.Size
+		info := &packets.PacketInfo{
+			Id: byte(cp.Id),
+			Read: func(b []byte) (packets.Packet, error) {
+				if len(b) != size {
+					return nil, fmt.Errorf("kurafuto: Custom packet %#.2x is %d bytes, expected %d", b[0], len(b), size)
+				}
+				data := make([]byte, len(b))
+				copy(data, b)
+				return &RawPacket{data}, nil
+			},
+			Size:      size,
+			Direction: packets.PacketDirection(cp.Direction),
+			Name:      cp.Name,
+		}
+		if _, err := packets.Register(info); err != nil {
+			return err
+		}
+		customPackets[cp.Id] = cp
+	}
+	return nil
+}
+
+// UnknownPacketError is returned by Parser.Next when the underlying parser fails
+// on the stream (most likely due to an unregistered packet id). Data holds the
+// raw bytes read while attempting to parse the packet, which starts with the
+// offending packet id (if anything was read at all).
+type UnknownPacketError struct {
+	Direction packets.PacketDirection
+	Data      []byte
+	Err       error
+}
+
+// PacketId returns the first byte read by the parser, which should be the id of
+// the packet it choked on.
+func (e *UnknownPacketError) PacketId() byte {
+	if len(e.Data) < 1 {
+		return 0x00
+	}
+	return e.Data[0]
+}
+
+// Dump returns a hexdump (like `hexdump -C`) of the raw bytes read.
+func (e *UnknownPacketError) Dump() string {
+	return hex.Dump(e.Data)
+}
+
+func (e *UnknownPacketError) Error() string {
+	return fmt.Sprintf("kurafuto: Unable to parse packet %#.2x (%d bytes read): %s", e.PacketId(), len(e.Data), e.Err)
+}
+
+// recorder is an io.Reader that keeps a copy of everything read through it since
+// the last call to Reset, up to a limit. It lets the Parser show what was on the
+// wire when Kyubu fails to parse a packet.
+type recorder struct {
+	r     io.Reader
+	buf   []byte
+	limit int
+}
+
+func (r *recorder) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if room := r.limit - len(r.buf); room > 0 {
+		if n < room {
+			room = n
+		}
+		r.buf = append(r.buf, b[:room]...)
+	}
+	return n, err
+}
+
+func (r *recorder) Reset() {
+	r.buf = r.buf[:0]
+}
+
+func (r *recorder) Bytes() []byte {
+	b := make([]byte, len(r.buf))
+	copy(b, r.buf)
+	return b
+}
+
 // Parser is a wrapper implementation of a Kyubu packets.Parser, which allows
 // function hooks to be run when specific packets are parsed out of the stream.
 // It also allows read timeouts, where if a packet isn't received in the specified
@@ -48,6 +174,7 @@ func (p AllPackets) Bytes() []byte {
 type Parser struct {
 	player    *Player
 	conn      net.Conn
+	raw       *recorder
 	parser    packets.Parser
 	hooks     map[byte][]hookInfo
 	Direction packets.PacketDirection
@@ -67,6 +194,16 @@ func (p *Parser) Finish() {
 	p.finished = true
 }
 
+// Finished returns whether the parser has been finished (or timed out).
+func (p *Parser) Finished() bool {
+	if p == nil {
+		return true
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.finished
+}
+
 // Next returns the next packet parsed out of the internal parser, and fires any
 // hooks related to this packet type. If any of the hooks return "handled", Next
 // will return `kurafuto.ErrPacketSkipped`. Users of the parser are expected to
@@ -88,6 +225,7 @@ func (p *Parser) Next() (packets.Packet, error) {
 	// time, we can consider the parser "finished".
 	p.conn.SetReadDeadline(time.Now().Add(p.Timeout))
 
+	p.raw.Reset()
 	packet, err := p.parser.Next()
 
 	if e, ok := err.(net.Error); ok && e.Timeout() {
@@ -95,6 +233,16 @@ func (p *Parser) Next() (packets.Packet, error) {
 		return nil, ErrParserFinished
 	}
 
+	// Anything that isn't the connection going away is the parser choking
+	// on the stream, so hand back what we read for the caller to deal with.
+	if _, ok := err.(net.Error); err != nil && !ok && err != io.EOF && err != io.ErrUnexpectedEOF {
+		e := &UnknownPacketError{Direction: p.Direction, Data: p.raw.Bytes(), Err: err}
+		if c := p.player.Capture(); c != nil && len(e.Data) > 0 {
+			c.Record(p.Direction, e.Data)
+		}
+		return nil, e
+	}
+
 	// An empty Time{} indicates removing the read deadline. I think.
 	// It's what Go's net/timeout_test.go does, so whatever.
 	p.conn.SetReadDeadline(time.Time{})
@@ -102,6 +250,10 @@ func (p *Parser) Next() (packets.Packet, error) {
 	if packet == nil {
 		return packet, err
 	}
+	countPacket(p.Direction, packet)
+	if c := p.player.Capture(); c != nil {
+		c.Record(p.Direction, packet.Bytes())
+	}
 
 	if p.Disable {
 		// Return early, we're ignoring hooks.
@@ -110,7 +262,10 @@ func (p *Parser) Next() (packets.Packet, error) {
 
 	skipPacket := func(h []hookInfo) bool {
 		for _, hook := range h {
-			if skip := hook.F(p.player, p.Direction, packet); skip {
+			start := time.Now()
+			skip := hook.F(p.player, p.Direction, packet)
+			metricHooks.WithLabelValues(hook.Name).Observe(since(start))
+			if skip {
 				return true
 			}
 		}
@@ -139,11 +294,24 @@ func (p *Parser) Register(packet packets.Packet, hook Hook) (string, error) {
 		p.hooks[packet.Id()] = []hookInfo{}
 	}
 	id := uniuri.NewLen(8)
-	info := hookInfo{Id: id, F: hook}
+	info := hookInfo{Id: id, Name: hookName(hook), F: hook}
 	p.hooks[packet.Id()] = append(p.hooks[packet.Id()], info)
 	return id, nil
 }
 
+// hookName returns the name of a hook's function, without the package path.
+func hookName(hook Hook) string {
+	f := runtime.FuncForPC(reflect.ValueOf(hook).Pointer())
+	if f == nil {
+		return "unknown"
+	}
+	name := f.Name()
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
 func (p *Parser) Unregister(hookId string) (bool, error) {
 	for id, hooks := range p.hooks {
 		for i, hook := range hooks {
@@ -165,10 +333,12 @@ func (p *Parser) UnregisterAll() {
 }
 
 func NewParser(player *Player, conn net.Conn, dir packets.PacketDirection, t time.Duration) packets.Parser {
+	raw := &recorder{r: conn, limit: 4096}
 	return &Parser{
 		player:    player,
 		conn:      conn,
-		parser:    packets.NewParser(conn, dir),
+		raw:       raw,
+		parser:    packets.NewParser(raw, dir),
 		hooks:     make(map[byte][]hookInfo),
 		Direction: dir,
 		mutex:     sync.Mutex{},
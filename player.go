@@ -3,8 +3,10 @@ package main
 import (
 	"crypto/md5"
 	"crypto/subtle"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,8 +22,28 @@ const (
 	Identification
 	Idle // this means we're just proxying packets for this user now.
 	Disconnected
+	Queued // waiting in the join queue for a server with room.
+	Limbo  // in the lobby, but not queued for anything.
 )
 
+func (s PlayerState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Identification:
+		return "identification"
+	case Idle:
+		return "idle"
+	case Disconnected:
+		return "disconnected"
+	case Queued:
+		return "queued"
+	case Limbo:
+		return "limbo"
+	}
+	return "unknown"
+}
+
 // compareHash compares a player's given "MpPass" against the computed hash
 // using the server's salt and the player's username. It uses crypto/subtle
 // to avoid any super-easy timing attacks.
@@ -51,18 +73,89 @@ func (b *BoundInfo) Empty() {
 
 type Player struct {
 	Id   string
-	Name string // From 0x00 Identification packet
-	CPE  bool   // Does this player claim CPE support?
+	name string // From 0x00 Identification packet
+	cpe  bool   // Does this player claim CPE support?
+
+	ident    *classic.Identification
+	loggedIn bool     // Whether they've made it on to a backend yet.
+	kicked   bool     // Whether their server sent them a DisconnectPlayer.
+	portal   *Backend // The lobby portal they're standing on.
+	global   bool     // Whether everything they say goes to global chat.
+	replyTo  string   // Who last sent them a private message.
 
 	Client BoundInfo // Client <-> Balancer
 	Server BoundInfo // Balancer <-> Server
 
-	State          PlayerState
+	state          PlayerState
+	Connected      time.Time // When the client connected to the balancer.
 	quit, quitting bool
-	hub            string
+	backend        *Backend
 	ku             *Kurafuto
 
+	// Which backend the player is counted on in metricPlayers, and whether
+	// they've quit, after which they aren't counted anywhere.
+	counted   *Backend
+	uncounted bool
+
+	// Packets the client sent while identifying (Identification, and the
+	// CPE ExtInfo/ExtEntry negotiation), which are replayed to any server
+	// the player is redirected to.
+	handshake []packets.Packet
+
+	capture *Capture // If set, every packet is recorded to it.
+
+	// Per-player rate limiting state, only touched by the client parser.
+	limits   map[byte]*TokenBucket
+	chat     *TokenBucket
+	lastChat string
+	lastTime time.Time
+	dupes    int
+
 	qMutex sync.Mutex
+	sMutex sync.Mutex // Guards p.Server, p.backend and p.counted, which Redirect swaps.
+	cMutex sync.Mutex // Guards p.capture.
+	tMutex sync.Mutex // Guards p.state, p.name, p.cpe and p.replyTo.
+}
+
+// Name returns the name the player identified with, or "" if they haven't yet.
+func (p *Player) Name() string {
+	p.tMutex.Lock()
+	defer p.tMutex.Unlock()
+	return p.name
+}
+
+// CPE returns whether the player's client supports CPE, as far as the server
+// they're on is concerned.
+func (p *Player) CPE() bool {
+	p.tMutex.Lock()
+	defer p.tMutex.Unlock()
+	return p.cpe
+}
+
+// State returns where the player is in their connection's lifecycle.
+func (p *Player) State() PlayerState {
+	p.tMutex.Lock()
+	defer p.tMutex.Unlock()
+	return p.state
+}
+
+// SetState moves the player on to another state.
+func (p *Player) SetState(state PlayerState) {
+	p.tMutex.Lock()
+	defer p.tMutex.Unlock()
+	p.state = state
+}
+
+// Log returns a log Entry with the player's context attached.
+func (p *Player) Log() *Entry {
+	f := Fields{"player_id": p.Id, "player_name": p.Name()}
+	if p.Client.Conn != nil {
+		f["remote"] = p.Remote()
+	}
+	if b := p.Backend(); b != nil {
+		f["backend"] = string(b.Name)
+	}
+	return WithFields(f)
 }
 
 // Remote returns a player's remote address (connecting IP) as a string.
@@ -70,6 +163,18 @@ func (p *Player) Remote() string {
 	return p.Client.Conn.RemoteAddr().String()
 }
 
+// IP returns a player's remote IP, without the port.
+func (p *Player) IP() net.IP {
+	if addr, ok := p.Client.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(p.Remote())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
 func (p *Player) Quit() {
 	p.qMutex.Lock()
 	if p.quit || p.quitting {
@@ -80,9 +185,17 @@ func (p *Player) Quit() {
 	p.quitting = true
 	p.qMutex.Unlock()
 
-	p.State = Disconnected
+	if b := p.Backend(); b != nil && p.State() == Idle {
+		p.ku.remember(p, b) // So the TTL counts from when they left.
+	}
+	p.sMutex.Lock()
+	p.uncounted = true
+	p.sMutex.Unlock()
+	p.countOn(nil)
+	p.SetState(Disconnected)
+	p.StopCapture()
 	rem := p.ku.Remove(p) // Ensure we're removed from the server's player list
-	Debugf("(%s) Remove(p) == %v", p.Id, rem)
+	p.Log().Debugf("Remove(p) == %v", rem)
 
 	go func() {
 		// Wait a bit to write any packets still in the queue.
@@ -92,6 +205,9 @@ func (p *Player) Quit() {
 		p.quit = true
 		p.qMutex.Unlock()
 
+		p.sMutex.Lock()
+		defer p.sMutex.Unlock()
+
 		p.Client.Parser.Finish()
 		p.Server.Parser.Finish()
 
@@ -123,33 +239,229 @@ func (p *Player) Quit() {
 // their connection. If packets.NewDisconnectPlayer returns an error, p.Quit is
 // called, and the error is returned.
 func (p *Player) Kick(msg string) error {
+	p.Log().Audit().Event("kick").Infof("%s (%s) was kicked: %s", p.Name(), p.Remote(), msg)
 	disc, err := classic.NewDisconnectPlayer(msg)
 	if err != nil {
 		p.Quit()
 		return err
 	}
-	p.Client.C <- disc
+	p.Send(disc)
 	p.Quit()
 	return nil
 }
 
-// Dial (attempts to) make an outbound connection to the stored hub address.
+// Send queues a packet to be sent to the client, returning false if the player
+// has quit, or the queue stayed full for a second.
+func (p *Player) Send(packet packets.Packet) bool {
+	p.qMutex.Lock()
+	defer p.qMutex.Unlock()
+	if p.quit {
+		return false
+	}
+	select {
+	case p.Client.C <- packet:
+		return true
+	case <-time.After(time.Second):
+		p.Log().Debugf("Send(): client queue full, dropping %#.2x", packet.Id())
+		return false
+	}
+}
+
+// Message sends the player a chat message from the balancer, split over as many
+// lines as it needs. Color codes are sanitized first, so a bad code can't crash
+// their client.
+func (p *Player) Message(message string) error {
+	for _, line := range splitChat(SanitizeColors(message, p.CPE())) {
+		msg, err := classic.NewMessage(127, line)
+		if err != nil {
+			return err
+		}
+		p.Send(msg)
+	}
+	return nil
+}
+
+// chatWidth is the longest chat message a classic Message packet can hold.
+const chatWidth = 64
+
+// splitChat splits a chat message into lines which fit in a Message packet,
+// breaking at spaces where it can. Lines after the first are marked with "> ",
+// and carry on in the color the previous line ended in. The message should
+// already have been through SanitizeColors.
+func splitChat(message string) []string {
+	lines := []string{}
+	prefix := ""
+	for {
+		message = prefix + message
+		if len(message) <= chatWidth {
+			return append(lines, message)
+		}
+		cut := strings.LastIndex(message[:chatWidth+1], " ")
+		if cut <= len(prefix) {
+			cut = chatWidth
+			if message[cut-1] == '&' {
+				// Don't split a color code in two.
+				cut--
+			}
+		}
+		line := message[:cut]
+		prefix = "> "
+		if i := strings.LastIndex(line[:len(line)-1], "&"); i >= 0 {
+			prefix += line[i : i+2]
+		}
+		// A color code (or space) left at the end of the line does nothing,
+		// and trailing codes crash some clients.
+		for {
+			if n := len(line); n >= 2 && line[n-2] == '&' {
+				line = line[:n-2]
+			} else if n >= 1 && line[n-1] == ' ' {
+				line = line[:n-1]
+			} else {
+				break
+			}
+		}
+		lines = append(lines, line)
+
+		message = strings.TrimLeft(message[cut:], " ")
+		if message == "" {
+			return lines
+		}
+	}
+}
+
+// Backend returns the server this player is connected (or connecting) to.
+func (p *Player) Backend() *Backend {
+	p.sMutex.Lock()
+	defer p.sMutex.Unlock()
+	return p.backend
+}
+
+// conn returns the current connection for one side of the proxy. The server
+// side can be swapped out from under us by Redirect.
+func (p *Player) conn(b *BoundInfo) net.Conn {
+	p.sMutex.Lock()
+	defer p.sMutex.Unlock()
+	return b.Conn
+}
+
+// Dial (attempts to) make an outbound connection to the player's backend. It's
+// up to the caller to kick the player if it fails.
 func (p *Player) Dial() bool {
-	server, err := net.Dial("tcp", p.hub)
+	start := time.Now()
+	server, err := net.Dial("tcp", p.backend.Addr())
+	metricDial.WithLabelValues(string(p.backend.Name)).Observe(since(start))
+	p.backend.setHealthy(err == nil)
 	if err != nil {
-		Infof("(%s) Unable to dial hub: %s", p.Remote(), p.hub)
-		Debugf("(%s) Unable to dial remote server: %s (%s)", p.Id, p.hub, err.Error())
-		p.Quit()
+		p.Log().Event("dial_failed").Infof("%s unable to dial hub: %s", p.Remote(), p.backend.Addr())
+		p.Log().Debugf("Unable to dial remote server: %s (%s)", p.backend.Addr(), err.Error())
 		return false
 	}
 	p.Server.Conn = server
-	p.State = Identification
+	p.SetState(Identification)
+	p.countOn(p.backend)
 	return true
 }
 
-func (p *Player) Redirect(address string, port int) error {
-	// TODO: Close p.Server, reopen, reboot write() loop.
-	// This will mean we'll have to buffer packets to retransmit, won't we?
+// countOn moves the player's place in metricPlayers on to b, or takes them out
+// of it if b is nil. Players are only counted once they've dialed a backend,
+// and never after they quit, so a quit racing a join or a redirect can't leave
+// the gauge off.
+func (p *Player) countOn(b *Backend) {
+	p.sMutex.Lock()
+	defer p.sMutex.Unlock()
+	if p.uncounted {
+		b = nil
+	}
+	if p.counted == b {
+		return
+	}
+	if p.counted != nil {
+		metricPlayers.WithLabelValues(string(p.counted.Name)).Dec()
+	}
+	if b != nil {
+		metricPlayers.WithLabelValues(string(b.Name)).Inc()
+	}
+	p.counted = b
+}
+
+// despawnAll tells the client to forget every entity. We don't track which
+// entities a server spawned, so this is done whenever they leave one. It's
+// only a couple of hundred bytes.
+func (p *Player) despawnAll() {
+	for i := 0; i < 128; i++ {
+		desp, err := classic.NewDespawnPlayer(int8(i))
+		if err != nil {
+			continue
+		}
+		p.Send(desp)
+	}
+}
+
+// connect dials a backend and sends it the player's handshake, returning the
+// connection and a (hooked) parser for it, ready to be swapped in.
+func (p *Player) connect(b *Backend) (net.Conn, *Parser, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", b.Addr(), 5*time.Second)
+	metricDial.WithLabelValues(string(b.Name)).Observe(since(start))
+	b.setHealthy(err == nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, packet := range p.handshake {
+		if _, err := conn.Write(packet.Bytes()); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+
+	parser := NewParser(p, conn, packets.ClientBound, p.Client.Parser.Timeout).(*Parser)
+	p.hookServer(parser)
+	return conn, parser, nil
+}
+
+// Redirect moves the player to another backend. The new server is dialed and
+// sent the player's original handshake, then swapped in for the old one. The
+// client is told to forget any entities it knew about from the old server, and
+// the new server's own CPE negotiation is dropped, since the client has already
+// done that. If the backend is full, errBackendFull is returned.
+func (p *Player) Redirect(b *Backend) error {
+	if p.State() != Idle {
+		return errors.New("kurafuto: Player isn't connected to a server")
+	}
+	current := p.Backend()
+	if current == b {
+		return fmt.Errorf("kurafuto: Player is already on %s", b.Name)
+	}
+
+	// Hold their place on the new backend while we dial it.
+	if !p.ku.Players.Reserve(p, b) {
+		return errBackendFull
+	}
+
+	conn, parser, err := p.connect(b)
+	if err != nil {
+		p.ku.Players.SetBackend(p, current)
+		return err
+	}
+	parser.Register(AllPackets{}, DropHandshake)
+
+	p.sMutex.Lock()
+	old, oldParser, oldBackend := p.Server.Conn, p.Server.Parser, p.backend
+	p.Server.Conn, p.Server.Parser, p.backend = conn, parser, b
+	p.sMutex.Unlock()
+
+	// Finish the old parser first, so its readParse quietly stops, rather than
+	// quitting the player when we close the connection.
+	oldParser.Finish()
+	old.Close()
+
+	p.countOn(b)
+	p.Log().Audit().Event("move").Infof("%s (%s) moved from %s to %s", p.Name(), p.Remote(), oldBackend.Name, b.Name)
+	p.ku.remember(p, b)
+	p.despawnAll()
+
+	go p.readParse(parser, p.Client.C) // B <- S
 	return nil
 }
 
@@ -173,12 +485,23 @@ func (p *Player) readParse(parser packets.Parser, to chan packets.Packet) {
 		if err == ErrParserFinished {
 			break
 		}
+		if pa, ok := parser.(*Parser); ok && pa.Finished() {
+			// We've been swapped out by Redirect.
+			break
+		}
 
 		if err == ErrPacketSkipped {
 			continue
 		}
+		if e, ok := err.(*UnknownPacketError); ok {
+			p.unknownPacket(e)
+			return
+		}
 		if packet == nil || err != nil {
-			Debugf("(%s) readParse(): packet:%+v, err:%#v", p.Id, packet, err)
+			p.Log().Debugf("readParse(): packet:%+v, err:%#v", packet, err)
+			if pa, ok := parser.(*Parser); ok && pa.Direction == packets.ClientBound && p.fallBack(pa) {
+				return
+			}
 			p.Quit()
 			return
 		}
@@ -187,7 +510,31 @@ func (p *Player) readParse(parser packets.Parser, to chan packets.Packet) {
 	}
 }
 
-func (p *Player) writeParse(pack <-chan packets.Packet, conn net.Conn) {
+// unknownPacket deals with a packet that the parser couldn't make sense of,
+// according to the configured "unknown-packets" policy. Since we have no idea
+// how big the packet is, there's no way to recover the stream, so the player
+// is always disconnected.
+func (p *Player) unknownPacket(e *UnknownPacketError) {
+	from := "client"
+	if e.Direction == packets.ClientBound {
+		from = "server"
+	}
+
+	switch p.ku.Config().UnknownPackets {
+	case UnknownKick:
+		p.Log().Event("unknown_packet").Infof("Kicking %s (%s) for unknown %s packet %#.2x", p.Name(), p.Remote(), from, e.PacketId())
+		p.Kick(fmt.Sprintf("Unknown packet %#.2x from %s", e.PacketId(), from))
+		return
+	case UnknownHex:
+		p.Log().Event("unknown_packet").Warnf("Unknown %s packet %#.2x for %s (%d bytes read):\n%s", from, e.PacketId(), p.Name(), len(e.Data), e.Dump())
+	default:
+		p.Log().Event("unknown_packet").Infof("Unknown %s packet %#.2x for %s (%s), dropping connection", from, e.PacketId(), p.Name(), p.Remote())
+		p.Log().Debugf("%s", e.Error())
+	}
+	p.Quit()
+}
+
+func (p *Player) writeParse(pack <-chan packets.Packet, b *BoundInfo) {
 	defer func() {
 		if err := recover(); !p.quitting && err != nil {
 			panic(err)
@@ -197,112 +544,259 @@ func (p *Player) writeParse(pack <-chan packets.Packet, conn net.Conn) {
 	for {
 		packet, ok := <-pack
 		if packet == nil || !ok {
-			Debugf("(%s) writeParse(): nil packet? ok:%v", p.Id, ok)
+			p.Log().Debugf("writeParse(): nil packet? ok:%v", ok)
 			p.Quit()
 			return
 		}
 
+		conn := p.conn(b)
+		if conn == nil {
+			// Queued players don't have a server yet.
+			continue
+		}
 		n, err := conn.Write(packet.Bytes())
+		if err != nil && p.conn(b) != conn {
+			// We were redirected mid-write, so try the new server (if they
+			// haven't ended up in the lobby instead).
+			if conn = p.conn(b); conn == nil {
+				continue
+			}
+			n, err = conn.Write(packet.Bytes())
+		}
+		if err != nil && b == &p.Server && p.ku.Config().Lobby.Enabled {
+			// Leave it to readParse to notice the server's gone, and send
+			// them to the lobby (or not).
+			continue
+		}
 		if err != nil {
-			Debugf("(%s) writeParse(): conn.Write err: %#v", p.Id, err)
+			p.Log().Debugf("writeParse(): conn.Write err: %#v", err)
 			p.Quit()
 			return
 		}
 		if n != packet.Size() {
-			Debugf("(%s) Packet %#.2x is %d bytes, but %d was written", p.Id, packet.Id(), packet.Size(), n)
+			p.Log().Debugf("Packet %#.2x is %d bytes, but %d was written", packet.Id(), packet.Size(), n)
 		}
 	}
 }
 
-func (p *Player) Parse() {
-	// TODO: Dial in a goroutine so that we can parse the client's Identification
-	// in the mean time.
-	if !p.Dial() {
+// login marks the player as logged in, once they've been sent to a backend.
+func (p *Player) login() {
+	p.SetState(Idle)
+	p.ku.remember(p, p.Backend())
+	if p.loggedIn {
+		p.Log().Event("rejoin").Infof("%s (%s) rejoined %s", p.Name(), p.Remote(), p.Backend().Name)
 		return
 	}
-	Debugf("(%s) Dialed %s!", p.Id, p.Server.Conn.RemoteAddr().String())
+	p.loggedIn = true
+	p.Log().Audit().Event("login").Infof("%s (%s) logged in to %s", p.Name(), p.Remote(), p.Backend().Name)
+	// Let peers know straight away, so they can spot duplicate logins.
+	p.ku.Mesh.poke()
+	if p.ku.Config().Capture.Wants(p.Name()) {
+		if err := p.StartCapture(p.ku.Config().Capture.Dir); err != nil {
+			p.Log().Warnf("Unable to capture packets: %s", err)
+		}
+	}
+}
+
+// claim claims the player's name in the name index, dealing with anyone else
+// using the same name according to the duplicate login policy. It returns false
+// if the player has been turned away.
+func (p *Player) claim() bool {
+	policy := p.ku.Config().DuplicateLogins
+	if node := p.ku.Mesh.Where(p.Name()); node != "" {
+		switch policy {
+		case DuplicateReject:
+			p.Log().Event("duplicate_login").Infof("%s (%s) is already logged in on %s", p.Name(), p.Remote(), node)
+			metricRejected.WithLabelValues(RejectDuplicate).Inc()
+			p.Kick("You're already logged in!")
+			return false
+		case DuplicateKickOld:
+			p.ku.Mesh.Publish(&MeshEvent{Type: MeshKick, Target: p.Name(), Reason: "You logged in from another location."})
+		}
+	}
+	existing, ok := p.ku.Players.Claim(p, policy == DuplicateKickOld, policy == DuplicateAllow)
+	if !ok {
+		p.Log().Event("duplicate_login").Infof("%s (%s) is already logged in", p.Name(), p.Remote())
+		metricRejected.WithLabelValues(RejectDuplicate).Inc()
+		p.Kick("You're already logged in!")
+		return false
+	}
+	if policy == DuplicateKickOld {
+		for _, old := range existing {
+			old.Log().Event("duplicate_login").Infof("%s logged in again from %s", old.Name(), p.Remote())
+			old.Kick("You logged in from another location.")
+		}
+	}
+	return true
+}
 
+// hookClient registers the standard hooks on a client (C -> B) parser.
+func (p *Player) hookClient(parser *Parser) {
+	limits := p.ku.Config().PacketLimits
+	p.limits = map[byte]*TokenBucket{}
+	for id, r := range limits.Packets {
+		p.limits[id] = NewTokenBucket(r)
+	}
+	p.chat = NewTokenBucket(limits.Chat.RateLimit)
+
+	parser.Register(AllPackets{}, RecordHandshake)
+	parser.Register(AllPackets{}, LimitPackets)
+	parser.Register(AllPackets{}, DropPacket)
+	parser.Register(classic.Message{}, LimitChat)
+	parser.Register(AllPackets{}, UsePortal)
+	if HasSink(ChannelChat) {
+		parser.Register(classic.Message{}, LogMessage)
+	}
+
+	if p.ku.Config().EdgeCommands {
+		parser.Register(classic.Message{}, EdgeCommand)
+	}
+	parser.Register(classic.Message{}, GlobalChat)
+}
+
+// hookServer registers the standard hooks on a server (B <- S) parser.
+func (p *Player) hookServer(parser *Parser) {
+	parser.Register(AllPackets{}, DropPacket)
+	parser.Register(AllPackets{}, TrackTextColor)
+	parser.Register(classic.DisconnectPlayer{}, TrackDisconnect)
+	if HasSink(ChannelChat) {
+		parser.Register(classic.Message{}, LogMessage)
+	}
+}
+
+func (p *Player) Parse() {
 	t := 2 * time.Second // TODO: Higher, lower? Notchian does 2-3s.
 	p.Client.Parser = NewParser(p, p.Client.Conn, packets.ServerBound, t).(*Parser)
-	p.Server.Parser = NewParser(p, p.Server.Conn, packets.ClientBound, t).(*Parser)
-
-	// TODO: Config option to log messages?
-	//p.client.Register(packets.Message{}, LogMessage)
-	//p.server.Register(packets.Message{}, LogMessage)
 
 	// General hooks to drop/debug log packets first.
 	//p.client.Register(AllPackets{}, DebugPacket) // TODO
 	//p.server.Register(AllPackets{}, DebugPacket) // TODO
-	p.Client.Parser.Register(AllPackets{}, DropPacket)
-	p.Server.Parser.Register(AllPackets{}, DropPacket)
-
-	if p.ku.Config.EdgeCommands {
-		p.Client.Parser.Register(classic.Message{}, EdgeCommand)
-	}
+	p.hookClient(p.Client.Parser)
 
 	// So we can shove packets down the pipe about identification.
-	go p.readParse(p.Client.Parser, p.Server.C) // C -> B
-	go p.writeParse(p.Client.C, p.Client.Conn)  // C <- B
+	go p.writeParse(p.Client.C, &p.Client) // C <- B
 
+	// We read the client's Identification before dialing anything, so that
+	// players we're going to turn away never reach a backend.
 	packet, err := p.Client.Parser.Next()
 
 	// This might indicate a read timeout, so just in case we shove down a
 	// DisconnectPlayer packet and kill their connections.
 	if err == ErrParserFinished {
-		Infof("(%s) Connected, but didn't send anything in time.", p.Remote())
+		p.Log().Event("ident_timeout").Infof("%s connected, but didn't send anything in time.", p.Remote())
+		metricRejected.WithLabelValues(RejectIdentTimeout).Inc()
 		p.Kick("You need to log in!")
 		return
 	}
 
 	if packet == nil || err != nil || packet.Id() != 0x00 {
 		// 0x00 = Identification
-		Infof("%s didn't identify correctly.", p.Remote())
-		Debugf("(%s) !ident: packet:%#v err:%#v", p.Id, packet, err)
+		p.Log().Event("ident_invalid").Infof("%s didn't identify correctly.", p.Remote())
+		p.Log().Debugf("!ident: packet:%#v err:%#v", packet, err)
+		metricRejected.WithLabelValues(RejectIdent).Inc()
 		p.Quit()
 		return
 	}
 
-	// We'll pass it on eventually.
-	p.Server.C <- packet
-
 	// Store their username!
 	var ident *classic.Identification
 	ident = packet.(*classic.Identification)
-	p.Name = ident.Name
-	p.CPE = ident.UserType == 0x42 // Magic value for CPE
+	p.tMutex.Lock()
+	p.name = ident.Name
+	p.cpe = ident.UserType == 0x42 // Magic value for CPE
+	p.tMutex.Unlock()
+	p.ident = ident
+
+	if ban := p.ku.Bans.Check(p.Name(), p.IP()); ban != nil {
+		p.Log().Event("banned").Infof("%s (%s) is banned: %s", p.Name(), p.Remote(), ban)
+		metricRejected.WithLabelValues(RejectBanned).Inc()
+		p.Kick(ban.Message())
+		return
+	}
 
 	// We handle authentication here if it's enabled, otherwise we just
 	// pull out the username from the initial Identification packet.
 	// NOTE: This only supports ClassiCube.
 	// TODO: Support Notchian authentication.
 	// TODO: Tidy this trash up.
-	if p.ku.Config.Authenticate && !compareHash(p.ku.salt, p.Name, ident.KeyMotd) {
-		Infof("(%s) Connected, but didn't verify for %s", p.Remote(), p.Name)
-		disc, err := classic.NewDisconnectPlayer("Name wasn't verified!")
-		if err != nil {
-			p.Quit()
-			return
-		}
-		p.Client.C <- disc
-		p.Quit()
+	if p.ku.Config().Authenticate && !compareHash(p.ku.salt, p.Name(), ident.KeyMotd) {
+		p.Log().Event("auth_failed").Infof("%s connected, but didn't verify for %s", p.Remote(), p.Name())
+		metricRejected.WithLabelValues(RejectAuth).Inc()
+		p.Kick("Name wasn't verified!")
 		return
 	}
 
-	// Now we can start to pass things along to the server.
+	if p.ku.Whitelist.Enabled() && !p.ku.Whitelisted(p.Name()) {
+		p.Log().Event("not_whitelisted").Infof("%s (%s) isn't whitelisted", p.Name(), p.Remote())
+		metricRejected.WithLabelValues(RejectWhitelist).Inc()
+		p.Kick(p.ku.Config().Whitelist.Message)
+		return
+	}
+
+	if p.ku.Players.Online() >= p.ku.Config().MaxPlayers && !p.ku.Config().IsStaff(p.Name()) {
+		p.Log().Event("full").Infof("%s (%s) connected, but we're full", p.Name(), p.Remote())
+		metricRejected.WithLabelValues(RejectFull).Inc()
+		p.Kick("The server is full!")
+		return
+	}
+
+	// Only once nothing else can turn them away, so a rejected login can't
+	// kick an existing session.
+	if !p.claim() {
+		return
+	}
+
+	// As a hub, the lobby is where everyone starts.
+	if !p.ku.Config().Lobby.Hub {
+		p.sMutex.Lock()
+		p.backend = p.ku.Pick(p)
+		p.sMutex.Unlock()
+	}
+	dialed := p.backend != nil && p.Dial()
+	if !dialed && p.backend != nil {
+		p.sMutex.Lock()
+		p.backend = nil
+		p.sMutex.Unlock()
+		p.ku.Players.SetBackend(p, nil)
+	}
+	if !dialed && p.Enqueue() {
+		// Keep reading from the client (for commands and portals, and so we
+		// notice them leaving). writeParse drops what they send until they
+		// have a server.
+		go p.readParse(p.Client.Parser, p.Server.C) // C -> B
+		go p.writeParse(p.Server.C, &p.Server)      // B -> S
+		return
+	}
+	if !dialed {
+		p.Log().Event("no_servers").Infof("%s (%s) connected, but no servers are available.", p.Name(), p.Remote())
+		metricRejected.WithLabelValues(RejectDial).Inc()
+		p.Kick("No servers are available right now.")
+		return
+	}
+	p.Log().Debugf("Dialed %s!", p.Server.Conn.RemoteAddr().String())
+
+	p.Server.Parser = NewParser(p, p.Server.Conn, packets.ClientBound, t).(*Parser)
+	p.hookServer(p.Server.Parser)
+
+	// Now we can start to pass things along to the server, starting with
+	// their Identification.
+	p.Server.C <- packet
+	p.login()
+	go p.readParse(p.Client.Parser, p.Server.C) // C -> B
 	go p.readParse(p.Server.Parser, p.Client.C) // B <- S
-	go p.writeParse(p.Server.C, p.Server.Conn)  // B -> S
+	go p.writeParse(p.Server.C, &p.Server)      // B -> S
 }
 
 func NewPlayer(c net.Conn, ku *Kurafuto) (p *Player, err error) {
 	p = &Player{
-		Id:  uniuri.NewLen(8),
-		ku:  ku,
-		hub: fmt.Sprintf("%s:%d", ku.Hub.Address, ku.Hub.Port),
+		Id:        uniuri.NewLen(8),
+		ku:        ku,
+		Connected: time.Now(),
 
-		Client: BoundInfo{C: make(chan packets.Packet, 64)},
+		Client: BoundInfo{Conn: c, C: make(chan packets.Packet, 64)},
 		Server: BoundInfo{C: make(chan packets.Packet, 64)},
 
-		State: Connecting,
+		state: Connecting,
 
 		qMutex: sync.Mutex{},
 	}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitChat(t *testing.T) {
+	a, b := strings.Repeat("a", 61), strings.Repeat("b", 10)
+	tests := []struct {
+		name     string
+		in       string
+		expected []string
+	}{
+		{"short", "&eHello world", []string{"&eHello world"}},
+		{"exact", strings.Repeat("a", chatWidth), []string{strings.Repeat("a", chatWidth)}},
+		{"at a space", a + " " + b, []string{a, "> " + b}},
+		{"carries color", "&c" + a + " " + b, []string{"&c" + a, "> &c" + b}},
+		{"carries last color", "&c" + strings.Repeat("a", 30) + " &e" + strings.Repeat("a", 28) + " " + b,
+			[]string{"&c" + strings.Repeat("a", 30) + " &e" + strings.Repeat("a", 28), "> &e" + b}},
+		{"no spaces", strings.Repeat("a", 100),
+			[]string{strings.Repeat("a", chatWidth), "> " + strings.Repeat("a", 36)}},
+		{"code on the boundary", strings.Repeat("a", 63) + "&c" + b,
+			[]string{strings.Repeat("a", 63), "> &c" + b}},
+		{"trailing code", a + " &c " + b, []string{a, "> &c" + b}},
+	}
+	for _, test := range tests {
+		lines := splitChat(test.in)
+		if !reflect.DeepEqual(lines, test.expected) {
+			t.Errorf("%s: splitChat(%q) = %q, want %q", test.name, test.in, lines, test.expected)
+		}
+		for _, line := range lines {
+			if len(line) > chatWidth {
+				t.Errorf("%s: line %q is longer than %d", test.name, line, chatWidth)
+			}
+			if n := len(line); n >= 2 && line[n-2] == '&' {
+				t.Errorf("%s: line %q ends with a color code", test.name, line)
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// JoinQueue holds players who've logged in while every server is full (or
+// down), in the lobby, and sends them on to a server as places open up. Priority names
+// go ahead of everyone else (but behind anyone else with priority).
+type JoinQueue struct {
+	ku      *Kurafuto
+	players []*Player
+	mutex   sync.Mutex
+}
+
+// Add puts a player in the queue, returning their position (from 1).
+func (q *JoinQueue) Add(p *Player) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	i := len(q.players)
+	if q.ku.Config().Queue.HasPriority(p.Name()) {
+		for i = 0; i < len(q.players); i++ {
+			if !q.ku.Config().Queue.HasPriority(q.players[i].Name()) {
+				break
+			}
+		}
+	}
+	q.players = append(q.players, nil)
+	copy(q.players[i+1:], q.players[i:])
+	q.players[i] = p
+	metricQueued.Set(float64(len(q.players)))
+	return i + 1
+}
+
+// Remove takes a player out of the queue, returning false if they weren't in
+// it.
+func (q *JoinQueue) Remove(p *Player) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, player := range q.players {
+		if player != p {
+			continue
+		}
+		q.players = append(q.players[:i], q.players[i+1:]...)
+		metricQueued.Set(float64(len(q.players)))
+		return true
+	}
+	return false
+}
+
+// Position returns a player's position in the queue (from 1), or 0 if they
+// aren't in it.
+func (q *JoinQueue) Position(p *Player) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, player := range q.players {
+		if player == p {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Len returns how many players are queued.
+func (q *JoinQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.players)
+}
+
+// Snapshot returns a copy of the queue, in order.
+func (q *JoinQueue) Snapshot() []*Player {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	players := make([]*Player, len(q.players))
+	copy(players, q.players)
+	return players
+}
+
+// advance sends players at the front of the queue on to any servers with room
+// for them. If announce is set, everyone left is told where they are.
+func (q *JoinQueue) advance(announce bool) {
+	pos := 0
+	for _, p := range q.Snapshot() {
+		if b := q.ku.Pick(p); b != nil {
+			if q.Remove(p) {
+				p.SetState(Identification)
+				go q.join(p, b)
+			} else {
+				// They left the queue while we were picking, so give up the
+				// place Pick reserved for them.
+				q.ku.Players.SetBackend(p, nil)
+			}
+			continue
+		}
+		pos++
+		if announce {
+			p.Message(fmt.Sprintf("&eYou are #%d in queue.", pos))
+		}
+	}
+}
+
+// join sends a player from the front of the queue on to a backend. If it can't
+// be reached, they go back in the queue if the lobby's enabled, or are kicked.
+func (q *JoinQueue) join(p *Player, b *Backend) {
+	err := p.Join(b)
+	if err == nil {
+		return
+	}
+	p.Log().Debugf("Unable to send %s to %s: %s", p.Name(), b.Name, err)
+	if !q.ku.Config().Lobby.Enabled {
+		metricRejected.WithLabelValues(RejectDial).Inc()
+		p.Kick("Unable to reach the server, try again later.")
+		return
+	}
+	p.Message(fmt.Sprintf("&cUnable to reach %s, try again later.", b.Name))
+	p.SetState(Queued)
+	q.Add(p)
+}
+
+// run advances the queue whenever someone leaves a server (or the proxy), and
+// every interval, until Kurafuto stops running.
+func (q *JoinQueue) run(interval time.Duration) {
+	changes, stop := q.ku.Players.Watch(64)
+	defer stop()
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		ku := q.ku
+		ku.rMut.Lock()
+		running := ku.Running
+		ku.rMut.Unlock()
+		if !running {
+			return
+		}
+
+		select {
+		case c := <-changes:
+			switch {
+			case c.Event == PlayerRemoved:
+				q.Remove(c.Player)
+				if c.Backend != nil {
+					q.advance(false)
+				}
+			case c.Event == PlayerMoved && c.From != nil:
+				q.advance(false)
+			}
+		case <-tick.C:
+			q.advance(true)
+		}
+	}
+}
+
+func NewJoinQueue(ku *Kurafuto) *JoinQueue {
+	return &JoinQueue{ku: ku, players: []*Player{}}
+}
+
+////
+
+// Enqueue holds a player who couldn't be given a server in the lobby, and puts
+// them in the join queue (or, if the lobby's a hub, leaves them to pick a server
+// themselves). It returns false if neither the queue nor the lobby are enabled,
+// or the queue is full. It's up to the caller to keep reading from the client.
+func (p *Player) Enqueue() bool {
+	c := p.ku.Config()
+	if !c.Queue.Enabled && !c.Lobby.Enabled {
+		return false
+	}
+	if !c.Lobby.Hub && c.Queue.Max > 0 && p.ku.Queue.Len() >= c.Queue.Max && !c.Queue.HasPriority(p.Name()) {
+		return false
+	}
+	if err := p.dropCPE(); err != nil {
+		return false
+	}
+
+	state, status := Queued, "&eEvery server is full!"
+	if c.Lobby.Hub {
+		state, status = Limbo, "&eWelcome!"
+	} else if !p.ku.anyHealthy() {
+		status = c.Lobby.Message
+	}
+	if err := p.hold(state, status); err != nil {
+		p.Log().Warnf("Unable to send the lobby: %s", err)
+		return false
+	}
+	return true
+}
+
+// Join sends a player in the lobby on to a backend, which has already been
+// reserved for them.
+func (p *Player) Join(b *Backend) error {
+	conn, parser, err := p.connect(b)
+	if err != nil {
+		p.ku.Players.SetBackend(p, nil)
+		return err
+	}
+	if p.CPE() {
+		// They negotiated CPE with a server before they ended up here.
+		parser.Register(AllPackets{}, DropHandshake)
+	}
+
+	p.sMutex.Lock()
+	p.Server.Conn, p.Server.Parser, p.backend = conn, parser, b
+	p.sMutex.Unlock()
+	p.ku.Players.SetBackend(p, b)
+	p.countOn(b)
+
+	p.login()
+	go p.readParse(parser, p.Client.C) // B <- S
+	return nil
+}
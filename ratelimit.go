@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kurafuto/kyubu/modern/minimal"
+)
+
+// TokenBucket is a simple token bucket rate limiter: it holds up to Burst
+// tokens, refilled at Rate tokens a second, and each event takes a token. A
+// zero Rate means no limit.
+type TokenBucket struct {
+	Rate  float64
+	Burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+// Allow takes a token, returning false if there weren't any left.
+func (b *TokenBucket) Allow() bool {
+	if b.Rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = b.Burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.Rate
+		if b.tokens > b.Burst {
+			b.tokens = b.Burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Full returns whether the bucket has refilled completely, meaning it's the same
+// as a brand new bucket and can be thrown away.
+func (b *TokenBucket) Full() bool {
+	if b.last.IsZero() {
+		return true
+	}
+	return b.tokens+time.Since(b.last).Seconds()*b.Rate >= b.Burst
+}
+
+func NewTokenBucket(r RateLimit) *TokenBucket {
+	burst := float64(r.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{Rate: r.Rate, Burst: burst}
+}
+
+////
+
+// LimitError is returned by ConnLimiter.Accept when a connection is over a
+// limit. Reason is a metric label, and Message is shown to the client.
+type LimitError struct {
+	Reason  string
+	Message string
+}
+
+func (e *LimitError) Error() string {
+	return e.Message
+}
+
+// ConnLimiter limits new connections, both globally and per IP, and how many
+// connections a single IP may have open at once.
+type ConnLimiter struct {
+	config LimitsConfig
+	global *TokenBucket
+	perIP  map[string]*TokenBucket
+	conns  map[string]int
+	pruned time.Time
+	mutex  sync.Mutex
+}
+
+// Accept checks whether a new connection from ip is allowed, and if it is,
+// counts it as open until Release is called.
+func (l *ConnLimiter) Accept(ip string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.prune()
+
+	if max := l.config.MaxPerIP; max > 0 && l.conns[ip] >= max {
+		return &LimitError{RejectIPLimit, "Too many connections from your IP!"}
+	}
+	if !l.global.Allow() {
+		return &LimitError{RejectRateLimit, "The server is busy, try again in a moment."}
+	}
+	b, ok := l.perIP[ip]
+	if !ok {
+		b = NewTokenBucket(l.config.PerIP)
+		l.perIP[ip] = b
+	}
+	if !b.Allow() {
+		return &LimitError{RejectRateLimit, "You're connecting too quickly, slow down!"}
+	}
+	l.conns[ip]++
+	return nil
+}
+
+// Release marks a connection from ip as closed.
+func (l *ConnLimiter) Release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conns[ip] <= 1 {
+		delete(l.conns, ip)
+		return
+	}
+	l.conns[ip]--
+}
+
+// prune throws away per-IP buckets which have refilled, every so often, so the
+// map doesn't grow forever.
+func (l *ConnLimiter) prune() {
+	if time.Since(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = time.Now()
+	for ip, b := range l.perIP {
+		if b.Full() {
+			delete(l.perIP, ip)
+		}
+	}
+}
+
+func NewConnLimiter(c LimitsConfig) *ConnLimiter {
+	return &ConnLimiter{
+		config: c,
+		global: NewTokenBucket(c.Global),
+		perIP:  map[string]*TokenBucket{},
+		conns:  map[string]int{},
+		pruned: time.Now(),
+	}
+}
+
+// connIP returns the IP a connection is coming from, as a string.
+func connIP(c net.Conn) string {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+// reject sends a DisconnectPlayer packet down a connection which never became a
+// Player, then closes it.
+func reject(c net.Conn, msg string) {
+	defer c.Close()
+	disc, err := classic.NewDisconnectPlayer(msg)
+	if err != nil {
+		return
+	}
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Write(disc.Bytes())
+}
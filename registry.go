@@ -0,0 +1,337 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// RegistryEvent is the kind of change a RegistryChange describes.
+type RegistryEvent int
+
+const (
+	PlayerAdded   RegistryEvent = iota // A new connection was accepted.
+	PlayerNamed                        // The player identified, and claimed their name.
+	PlayerMoved                        // The player was assigned (or moved) to a backend.
+	PlayerRemoved                      // The player disconnected.
+)
+
+func (e RegistryEvent) String() string {
+	switch e {
+	case PlayerAdded:
+		return "added"
+	case PlayerNamed:
+		return "named"
+	case PlayerMoved:
+		return "moved"
+	case PlayerRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// RegistryChange is sent to watchers whenever the registry changes. For
+// PlayerMoved, From is the backend the player was on before (or nil).
+type RegistryChange struct {
+	Event   RegistryEvent
+	Player  *Player
+	Backend *Backend
+	From    *Backend
+}
+
+// Registry is the set of connected players, indexed by ID, name and backend.
+// Every method is safe to call from any goroutine.
+type Registry struct {
+	players  []*Player            // In connection order.
+	ids      map[string]*Player   // Player ID -> player.
+	names    map[string][]*Player // Lowercased name -> identified players.
+	backends map[*Player]*Backend // Player -> the backend they're on.
+	counts   map[*Backend]int     // Backend -> how many players are on it.
+
+	watchers map[chan RegistryChange]bool
+	empty    chan struct{} // Closed (and reset) when the registry empties.
+	mutex    sync.RWMutex
+}
+
+// Add adds a newly accepted player, returning how many players are connected.
+func (r *Registry) Add(p *Player) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.players = append(r.players, p)
+	r.ids[p.Id] = p
+	r.notify(RegistryChange{Event: PlayerAdded, Player: p})
+	return len(r.players)
+}
+
+// Remove removes a player from every index. It returns false if they weren't
+// in the registry (because they'd already been removed).
+func (r *Registry) Remove(p *Player) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.ids[p.Id] != p {
+		return false
+	}
+	delete(r.ids, p.Id)
+	for i, player := range r.players {
+		if player != p {
+			continue
+		}
+		// Remove and zero player to allow GC to collect it.
+		copy(r.players[i:], r.players[i+1:])
+		r.players[len(r.players)-1] = nil
+		r.players = r.players[:len(r.players)-1]
+		break
+	}
+	r.unclaim(p)
+	b := r.backends[p]
+	r.setBackend(p, nil)
+	r.notify(RegistryChange{Event: PlayerRemoved, Player: p, Backend: b})
+
+	if len(r.players) == 0 && r.empty != nil {
+		close(r.empty)
+		r.empty = nil
+	}
+	return true
+}
+
+// Claim indexes an identified player by name. If someone already has that name,
+// they're returned, and the claim only succeeds if replace or allow is true.
+// With replace, the existing sessions are dropped from the index (it's up to the
+// caller to kick them). With allow, the new session is added alongside them.
+func (r *Registry) Claim(p *Player, replace, allow bool) (existing []*Player, ok bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.ids[p.Id] != p {
+		// They've already disconnected, so don't index them again.
+		return nil, false
+	}
+	name := strings.ToLower(p.Name())
+	existing = r.names[name]
+	switch {
+	case len(existing) == 0 || allow:
+		r.names[name] = append(r.names[name], p)
+	case replace:
+		r.names[name] = []*Player{p}
+	default:
+		return existing, false
+	}
+	r.notify(RegistryChange{Event: PlayerNamed, Player: p})
+	return existing, true
+}
+
+// unclaim removes a player from the name index. The caller must hold r.mutex.
+func (r *Registry) unclaim(p *Player) {
+	name := strings.ToLower(p.Name())
+	ps := r.names[name]
+	for i, player := range ps {
+		if player != p {
+			continue
+		}
+		ps = append(ps[:i:i], ps[i+1:]...)
+		break
+	}
+	if len(ps) == 0 {
+		delete(r.names, name)
+	} else {
+		r.names[name] = ps
+	}
+}
+
+// SetBackend records which backend a player is on, for Count and OnBackend.
+func (r *Registry) SetBackend(p *Player, b *Backend) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.ids[p.Id] != p {
+		return
+	}
+	from := r.backends[p]
+	if from == b {
+		return
+	}
+	r.setBackend(p, b)
+	r.notify(RegistryChange{Event: PlayerMoved, Player: p, Backend: b, From: from})
+}
+
+// Reserve moves a player onto a backend, like SetBackend, but only if there's
+// room for them there. The check and the move happen together, so simultaneous
+// joins can't overfill a backend. Only players in this registry are counted,
+// so MaxPlayers is a limit on this instance, not on the backend as a whole.
+func (r *Registry) Reserve(p *Player, b *Backend) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.ids[p.Id] != p {
+		return false
+	}
+	from := r.backends[p]
+	if from == b {
+		return true
+	}
+	if b.MaxPlayers > 0 && r.counts[b] >= b.MaxPlayers {
+		return false
+	}
+	r.setBackend(p, b)
+	r.notify(RegistryChange{Event: PlayerMoved, Player: p, Backend: b, From: from})
+	return true
+}
+
+// setBackend updates the backend indexes. The caller must hold r.mutex.
+func (r *Registry) setBackend(p *Player, b *Backend) {
+	if from, ok := r.backends[p]; ok {
+		if r.counts[from]--; r.counts[from] <= 0 {
+			delete(r.counts, from)
+		}
+		delete(r.backends, p)
+	}
+	if b != nil {
+		r.backends[p] = b
+		r.counts[b]++
+	}
+}
+
+// Rebind moves every player on one backend to another, and returns them. It's
+// for when a backend is replaced by a reload.
+func (r *Registry) Rebind(from, to *Backend) []*Player {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	moved := []*Player{}
+	for _, p := range r.players {
+		if r.backends[p] == from {
+			r.setBackend(p, to)
+			moved = append(moved, p)
+		}
+	}
+	return moved
+}
+
+// Get returns the player with the given ID, or nil.
+func (r *Registry) Get(id string) *Player {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.ids[id]
+}
+
+// Name returns the identified player with the given name (case insensitive), or
+// nil. If duplicate logins are allowed, it's the oldest of them.
+func (r *Registry) Name(name string) *Player {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if ps := r.names[strings.ToLower(name)]; len(ps) > 0 {
+		return ps[0]
+	}
+	return nil
+}
+
+// Find returns the player with the given name or ID, or nil.
+func (r *Registry) Find(s string) *Player {
+	if p := r.Name(s); p != nil {
+		return p
+	}
+	return r.Get(s)
+}
+
+// OnBackend returns the players on a backend, in connection order.
+func (r *Registry) OnBackend(b *Backend) []*Player {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	players := []*Player{}
+	for _, p := range r.players {
+		if r.backends[p] == b {
+			players = append(players, p)
+		}
+	}
+	return players
+}
+
+// Count returns how many players are on a backend.
+func (r *Registry) Count(b *Backend) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.counts[b]
+}
+
+// Snapshot returns a copy of the player list, in connection order, which is
+// safe to iterate over whilst players come and go.
+func (r *Registry) Snapshot() []*Player {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	players := make([]*Player, len(r.players))
+	copy(players, r.players)
+	return players
+}
+
+// Len returns how many connections there are, including ones which haven't
+// logged in yet.
+func (r *Registry) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.players)
+}
+
+// Online returns how many players have logged in (made it past identification,
+// and on to a backend).
+func (r *Registry) Online() int {
+	n := 0
+	for _, p := range r.Snapshot() {
+		if p.State() == Idle {
+			n++
+		}
+	}
+	return n
+}
+
+// Empty returns a channel which is closed once there are no players left. If
+// the registry is already empty, the channel is already closed.
+func (r *Registry) Empty() <-chan struct{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.players) == 0 {
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+	if r.empty == nil {
+		r.empty = make(chan struct{})
+	}
+	return r.empty
+}
+
+// Watch returns a channel which receives every change to the registry, and a
+// function to stop watching (which closes the channel). Changes are never
+// allowed to block the registry, so a watcher that falls more than buffer
+// changes behind misses some.
+func (r *Registry) Watch(buffer int) (<-chan RegistryChange, func()) {
+	c := make(chan RegistryChange, buffer)
+	r.mutex.Lock()
+	r.watchers[c] = true
+	r.mutex.Unlock()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			r.mutex.Lock()
+			delete(r.watchers, c)
+			r.mutex.Unlock()
+			close(c)
+		})
+	}
+}
+
+// notify sends a change to every watcher. The caller must hold r.mutex.
+func (r *Registry) notify(change RegistryChange) {
+	for c := range r.watchers {
+		select {
+		case c <- change:
+		default:
+		}
+	}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		players:  []*Player{},
+		ids:      map[string]*Player{},
+		names:    map[string][]*Player{},
+		backends: map[*Player]*Backend{},
+		counts:   map[*Backend]int{},
+		watchers: map[chan RegistryChange]bool{},
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	classic "github.com/kurafuto/kyubu/modern/minimal"
+)
+
+// testBackend accepts connections and reads (and throws away) whatever it's
+// sent, until the test ends.
+func testBackend(t *testing.T) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+// testKurafuto starts a Kurafuto on a random port, in front of one backend.
+func testKurafuto(t *testing.T) *Kurafuto {
+	b := testBackend(t)
+	dir := t.TempDir()
+	config, err := NewConfig(strings.NewReader(fmt.Sprintf(`{
+		"address": "127.0.0.1",
+		"port": 0,
+		"max-players": 1000,
+		"ban-file": %q,
+		"whitelist": {"file": %q},
+		"sticky": {"file": %q},
+		"servers": [{"name": "Server_A", "address": "127.0.0.1", "port": %d}]
+	}`, filepath.Join(dir, "bans.json"), filepath.Join(dir, "whitelist.json"),
+		filepath.Join(dir, "sessions.json"), b.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ku, err := NewKurafuto(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ku.Run()
+	waitFor(t, "Kurafuto to start", func() bool {
+		ku.rMut.Lock()
+		defer ku.rMut.Unlock()
+		return ku.Running
+	})
+	t.Cleanup(func() {
+		ku.Quit()
+		select {
+		case <-ku.Done:
+		case <-time.After(15 * time.Second):
+			t.Error("Kurafuto didn't shut down")
+		}
+	})
+	return ku
+}
+
+// waitFor polls cond until it's true, or fails the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Errorf("timed out waiting for %s", what)
+}
+
+// TestRegistryConcurrent connects and disconnects clients from several
+// goroutines at once, through the real join and leave paths, while others read
+// from the registry (and the players in it) the way the admin API, console and
+// chat do, so that `go test -race` can catch unsynchronized access.
+func TestRegistryConcurrent(t *testing.T) {
+	ku := testKurafuto(t)
+	admin := NewAdminAPI(ku, "token")
+	addr := ku.Listener.Addr().String()
+
+	const workers, rounds = 8, 10
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if i%3 == 0 {
+					// Leave before identifying.
+					c.Close()
+					continue
+				}
+				name := fmt.Sprintf("player%d_%d", w, i)
+				ident, _ := classic.NewIdentification(7, name, "", 0x00)
+				if _, err := c.Write(ident.Bytes()); err != nil {
+					t.Error(err)
+				}
+				waitFor(t, name+" to log in", func() bool {
+					p := ku.Players.Name(name)
+					return p != nil && p.State() == Idle
+				})
+				c.Close()
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, p := range ku.Players.Snapshot() {
+				p.Name()
+				p.CPE()
+				p.State()
+				p.Backend()
+			}
+			ku.Players.Online()
+			ku.Players.Find("player0_1")
+			ku.Broadcast("&eHello!")
+
+			req := httptest.NewRequest("GET", "/players", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			rec := httptest.NewRecorder()
+			admin.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("GET /players: %d %s", rec.Code, rec.Body)
+			}
+		}
+	}()
+	wg.Wait()
+
+	waitFor(t, "everyone to leave", func() bool { return ku.Players.Len() == 0 })
+	close(done)
+	readers.Wait()
+
+	if n := ku.Players.Online(); n != 0 {
+		t.Errorf("Online() = %d after everyone left, want 0", n)
+	}
+	if n := ku.Players.Count(ku.Backends()[0]); n != 0 {
+		t.Errorf("Count() = %d after everyone left, want 0", n)
+	}
+	select {
+	case <-ku.Players.Empty():
+	default:
+		t.Error("Empty() isn't closed after everyone left")
+	}
+}
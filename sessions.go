@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Session is where a player was last seen, for sticky sessions.
+type Session struct {
+	Server string    `json:"server"`
+	Seen   time.Time `json:"seen"`
+}
+
+// SessionStore remembers the last server each player was on, persisted to a
+// JSON file. Changes are kept in memory, and written out by Save.
+type SessionStore struct {
+	Filename string
+
+	sessions map[string]*Session // Lowercased name -> session.
+	dirty    bool
+	mutex    sync.Mutex
+}
+
+// Get returns the server a player was last on, or "" if they haven't been seen
+// within ttl.
+func (s *SessionStore) Get(name string, ttl time.Duration) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, ok := s.sessions[strings.ToLower(name)]
+	if !ok || time.Since(session.Seen) > ttl {
+		return ""
+	}
+	return session.Server
+}
+
+// Set records that a player is on a server.
+func (s *SessionStore) Set(name, server string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[strings.ToLower(name)] = &Session{Server: server, Seen: time.Now()}
+	s.dirty = true
+}
+
+// Save writes the sessions out (minus any older than ttl), via a temporary file
+// so a crash can't leave it half written. It does nothing if nothing's changed.
+func (s *SessionStore) Save(ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	for name, session := range s.sessions {
+		if time.Since(session.Seen) > ttl {
+			delete(s.sessions, name)
+		}
+	}
+
+	data, err := json.MarshalIndent(s.sessions, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := s.Filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.Filename); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// LoadSessions loads sessions from a JSON file. A missing file means nobody's
+// been seen yet.
+func LoadSessions(filename string) (*SessionStore, error) {
+	s := &SessionStore{Filename: filename, sessions: map[string]*Session{}}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.sessions); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+////
+
+// remember records the server a player is on, if sticky sessions are on, and
+// the server hasn't opted out.
+func (ku *Kurafuto) remember(p *Player, b *Backend) {
+	if !ku.Config().Sticky.Enabled || b.NoSticky {
+		return
+	}
+	ku.Sessions.Set(p.Name(), string(b.Name))
+}
+
+// lastServer returns the backend a player was last on, if sticky sessions are
+// on and they were seen recently enough, or nil.
+func (ku *Kurafuto) lastServer(p *Player) *Backend {
+	c := ku.Config().Sticky
+	if !c.Enabled {
+		return nil
+	}
+	name := ku.Sessions.Get(p.Name(), time.Duration(c.TTL))
+	if name == "" {
+		return nil
+	}
+	if b := ku.Backend(name); b != nil && !b.NoSticky {
+		return b
+	}
+	return nil
+}
+
+// storeSessions saves the sessions, unless we've handed over to a new process
+// with Upgrade, which looks after the sessions file from then on.
+func (ku *Kurafuto) storeSessions() {
+	ku.rMut.Lock()
+	upgraded := ku.upgraded
+	ku.rMut.Unlock()
+	if upgraded {
+		return
+	}
+	if err := ku.Sessions.Save(time.Duration(ku.Config().Sticky.TTL)); err != nil {
+		Warnf("Unable to save sessions: %s", err)
+	}
+}
+
+// saveSessions saves the sessions every interval, until Kurafuto stops running.
+func (ku *Kurafuto) saveSessions(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		ku.storeSessions()
+
+		ku.rMut.Lock()
+		running := ku.Running
+		ku.rMut.Unlock()
+		if !running {
+			return
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files handed down to a new process by Upgrade are passed as extra files, and
+// named in this environment variable, like "kurafuto=3,admin=4,ready=5".
+const inheritEnv = "KURAFUTO_INHERIT"
+
+var (
+	// Listeners we've opened (or inherited), by name, so they can be handed
+	// down to the next process.
+	listeners = map[string]net.Listener{}
+	lMutex    sync.Mutex
+
+	inherited map[string]*os.File
+)
+
+// inheritedFile returns the file named name which was handed down to us by the
+// process we're upgrading from, or nil. Each file can only be taken once.
+func inheritedFile(name string) *os.File {
+	lMutex.Lock()
+	defer lMutex.Unlock()
+	if inherited == nil {
+		inherited = map[string]*os.File{}
+		for _, pair := range strings.Split(os.Getenv(inheritEnv), ",") {
+			bits := strings.SplitN(pair, "=", 2)
+			if len(bits) != 2 {
+				continue
+			}
+			fd, err := strconv.Atoi(bits[1])
+			if err != nil {
+				continue
+			}
+			inherited[bits[0]] = os.NewFile(uintptr(fd), bits[0])
+		}
+		// Don't pass them on to anything we run.
+		os.Unsetenv(inheritEnv)
+	}
+	f := inherited[name]
+	delete(inherited, name)
+	return f
+}
+
+// listen returns a TCP listener on addr, named name. If the process we're
+// upgrading from handed down a listener with that name, it's used instead of
+// opening a new one, so changing addresses needs a full restart.
+func listen(name, addr string) (net.Listener, error) {
+	var l net.Listener
+	if f := inheritedFile(name); f != nil {
+		fl, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			Warnf("Unable to use inherited %s listener: %s", name, err)
+		} else {
+			Debugf("Inherited %s listener on %s", name, fl.Addr())
+			l = fl
+		}
+	}
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+
+	lMutex.Lock()
+	listeners[name] = l
+	lMutex.Unlock()
+	return l, nil
+}
+
+// closeListeners closes every listener opened with listen, except the one named
+// except.
+func closeListeners(except string) {
+	lMutex.Lock()
+	defer lMutex.Unlock()
+	for name, l := range listeners {
+		if name == except {
+			continue
+		}
+		l.Close()
+		delete(listeners, name)
+	}
+}
+
+// signalReady tells the process we're upgrading from (if there is one) that
+// we're up and accepting players, so it can start draining.
+func signalReady() {
+	if f := inheritedFile("ready"); f != nil {
+		f.Write([]byte{1})
+		f.Close()
+	}
+}
+
+// Upgrade starts a new Kurafuto process (from the same binary path, with the
+// same arguments, so a freshly deployed build) and hands it our listeners. Once
+// it's up, we stop accepting players and drain the ones we have, giving them
+// until the configured upgrade deadline before they're asked to reconnect. If
+// the new process fails to start, we carry on as if nothing happened.
+func (ku *Kurafuto) Upgrade() error {
+	ku.rMut.Lock()
+	running := ku.Running
+	ku.rMut.Unlock()
+	if !running {
+		return errors.New("kurafuto: Already shutting down")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	lMutex.Lock()
+	files, names := []*os.File{}, []string{}
+	for name, l := range listeners {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			lMutex.Unlock()
+			closeFiles(files)
+			return err
+		}
+		names = append(names, fmt.Sprintf("%s=%d", name, 3+len(files)))
+		files = append(files, f)
+	}
+	lMutex.Unlock()
+	defer closeFiles(files)
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	names = append(names, fmt.Sprintf("ready=%d", 3+len(files)))
+
+	// Hand over the latest sessions; the new process owns the file once it's
+	// up, so we stop saving it.
+	ku.storeSessions()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(), inheritEnv+"="+strings.Join(names, ","))
+	if err := cmd.Start(); err != nil {
+		readyW.Close()
+		return err
+	}
+	readyW.Close()
+	go cmd.Wait()
+
+	// The new process writes a byte once it's listening; if it exits first,
+	// we'll see EOF instead.
+	up := make(chan bool, 1)
+	go func() {
+		n, _ := ready.Read(make([]byte, 1))
+		up <- n > 0
+	}()
+	select {
+	case ok := <-up:
+		if !ok {
+			return errors.New("kurafuto: New process exited before it was ready")
+		}
+	case <-time.After(30 * time.Second):
+		cmd.Process.Kill()
+		return errors.New("kurafuto: New process took too long to start")
+	}
+
+	ku.rMut.Lock()
+	ku.upgraded = true
+	ku.rMut.Unlock()
+
+	Infof("Upgraded: new process %d is accepting players, draining %d players", cmd.Process.Pid, ku.Players.Len())
+	// drain closes the main listener itself, once Run knows to expect it.
+	go ku.drain(time.Duration(ku.Config().Drain.UpgradeDeadline),
+		"&eServer restarting in %s, reconnect any time.", "Server restarted, please reconnect.")
+	closeListeners("kurafuto")
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"os"
+)
+
+// notifyUpgrade does nothing, as there's no SIGUSR2 on Windows. Listeners can't
+// be handed down there either, so upgrades need a restart.
+func notifyUpgrade(c chan<- os.Signal) {}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Whitelist is a persisted list of names which are let in during maintenance.
+// While it's enabled, only listed names (and staff) can connect at all, but
+// single backends can also be whitelisted, so only listed names are sent there.
+type Whitelist struct {
+	Filename string
+
+	enabled bool
+	names   map[string]bool // Lowercased.
+	servers map[string]bool // Whitelisted backends.
+	mutex   sync.Mutex
+}
+
+// whitelistFile is how a Whitelist is stored on disk.
+type whitelistFile struct {
+	Enabled bool     `json:"enabled"`
+	Servers []string `json:"servers"`
+	Names   []string `json:"names"`
+}
+
+// Enabled returns whether the whole proxy is in maintenance (whitelist) mode.
+func (w *Whitelist) Enabled() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.enabled
+}
+
+// Contains returns whether a name is on the whitelist.
+func (w *Whitelist) Contains(name string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.names[strings.ToLower(name)]
+}
+
+// Server returns whether the named backend is whitelisted.
+func (w *Whitelist) Server(name string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.servers[strings.ToLower(name)]
+}
+
+// Names returns the whitelisted names, sorted.
+func (w *Whitelist) Names() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	names := []string{}
+	for n := range w.names {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetEnabled turns maintenance mode on or off, and saves the whitelist.
+func (w *Whitelist) SetEnabled(e bool) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.enabled = e
+	return w.save()
+}
+
+// SetServer whitelists a single backend (or stops whitelisting it), and saves
+// the whitelist.
+func (w *Whitelist) SetServer(name string, e bool) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if e {
+		w.servers[strings.ToLower(name)] = true
+	} else {
+		delete(w.servers, strings.ToLower(name))
+	}
+	return w.save()
+}
+
+// Add adds names to the whitelist, and saves it.
+func (w *Whitelist) Add(names ...string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, n := range names {
+		w.names[strings.ToLower(n)] = true
+	}
+	return w.save()
+}
+
+// Remove removes names from the whitelist, and saves it.
+func (w *Whitelist) Remove(names ...string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, n := range names {
+		delete(w.names, strings.ToLower(n))
+	}
+	return w.save()
+}
+
+func (w *Whitelist) save() error {
+	f := whitelistFile{Enabled: w.enabled, Servers: []string{}, Names: []string{}}
+	for n := range w.servers {
+		f.Servers = append(f.Servers, n)
+	}
+	for n := range w.names {
+		f.Names = append(f.Names, n)
+	}
+	sort.Strings(f.Servers)
+	sort.Strings(f.Names)
+
+	data, err := json.MarshalIndent(f, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := w.Filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.Filename)
+}
+
+// LoadWhitelist loads the whitelist from a JSON file. A missing file is an
+// empty (and disabled) whitelist.
+func LoadWhitelist(filename string) (*Whitelist, error) {
+	w := &Whitelist{Filename: filename, names: map[string]bool{}, servers: map[string]bool{}}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return w, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f whitelistFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	w.enabled = f.Enabled
+	for _, n := range f.Servers {
+		w.servers[strings.ToLower(n)] = true
+	}
+	for _, n := range f.Names {
+		w.names[strings.ToLower(n)] = true
+	}
+	return w, nil
+}
+
+////
+
+// Whitelisted returns whether the named player is allowed in while the whole
+// proxy is in maintenance mode. Moderators and admins always are.
+func (ku *Kurafuto) Whitelisted(name string) bool {
+	return ku.Whitelist.Contains(name) || ku.Config().IsStaff(name)
+}
+
+// AllowedOn returns whether the named player may be sent to a backend, taking
+// into account whether that backend is whitelisted.
+func (ku *Kurafuto) AllowedOn(name string, b *Backend) bool {
+	if !b.Whitelist && !ku.Whitelist.Server(string(b.Name)) {
+		return true
+	}
+	return ku.Whitelisted(name)
+}